@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/TrilliumIT/docker-arp-ipam/driver"
+	"github.com/urfave/cli"
+)
+
+// checkFlags are shared by the commands which probe outside of docker
+var checkFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "probe",
+		Value: driver.ProbeUDP,
+		Usage: "Method used to probe if an address is in use. One of: " + strings.Join(driver.ProbeMethods, ", "),
+	},
+	cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "Timeout probing each address. Zero for the default.",
+	},
+}
+
+var commands = []cli.Command{
+	{
+		Name:      "probe",
+		Usage:     "Probe an address and print its neighbor state",
+		ArgsUsage: "<ip>",
+		Flags:     checkFlags,
+		Action:    probeCmd,
+	},
+	{
+		Name:      "scan",
+		Usage:     "Probe every address in a local network and print whether it is used or free",
+		ArgsUsage: "<cidr>",
+		Flags: append([]cli.Flag{
+			cli.IntFlag{
+				Name:  "parallel, p",
+				Value: 32,
+				Usage: "Number of addresses to probe at once",
+			},
+		}, checkFlags...),
+		Action: scanCmd,
+	},
+	{
+		Name:      "suggest",
+		Usage:     "Print unused addresses from a local network the way random addresses are chosen for docker",
+		ArgsUsage: "<cidr>",
+		Flags: append([]cli.Flag{
+			cli.IntFlag{
+				Name:  "n",
+				Value: 1,
+				Usage: "Number of addresses to suggest",
+			},
+			cli.StringFlag{
+				Name:  "state-dir",
+				Value: "/var/lib/docker-arp-ipam",
+				Usage: "Directory allocations are persisted in, allocated addresses are not suggested. Empty to ignore allocations.",
+			},
+		}, checkFlags...),
+		Action: suggestCmd,
+	},
+}
+
+func probeCmd(ctx *cli.Context) error {
+	ip := net.ParseIP(ctx.Args().First())
+	if ip == nil {
+		return cli.NewExitError("probe requires an ip address", 1)
+	}
+	return withDriver(ctx, "", func(d *driver.Driver) error {
+		s := d.ProbeAddress(ip)
+		if s.Err != nil {
+			return s.Err
+		}
+		printState(s)
+		return nil
+	})
+}
+
+func scanCmd(ctx *cli.Context) error {
+	cidr := ctx.Args().First()
+	if cidr == "" {
+		return cli.NewExitError("scan requires a network", 1)
+	}
+	return withDriver(ctx, "", func(d *driver.Driver) error {
+		res, err := d.Scan(cidr, ctx.Int("parallel"))
+		if err != nil {
+			return err
+		}
+		used := 0
+		for _, s := range res {
+			if s.InUse {
+				used++
+			}
+			printState(s)
+		}
+		fmt.Printf("%v used, %v free\n", used, len(res)-used)
+		return nil
+	})
+}
+
+func suggestCmd(ctx *cli.Context) error {
+	cidr := ctx.Args().First()
+	if cidr == "" {
+		return cli.NewExitError("suggest requires a network", 1)
+	}
+	return withDriver(ctx, ctx.String("state-dir"), func(d *driver.Driver) error {
+		ips, err := d.Suggest(cidr, ctx.Int("n"))
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			fmt.Println(ip)
+		}
+		return nil
+	})
+}
+
+func printState(s *driver.AddrState) {
+	status := "free"
+	if s.InUse {
+		status = "used"
+	}
+	if s.Err != nil {
+		status = "unknown"
+	}
+	l := fmt.Sprintf("%v\t%v\t%v", s.IP, status, s.Neighbor)
+	if s.HardwareAddr != nil {
+		l += "\t" + s.HardwareAddr.String()
+	}
+	if s.Err != nil {
+		l += "\t" + s.Err.Error()
+	}
+	fmt.Println(l)
+}
+
+// withDriver runs fn with a driver which only probes. Allocations are read
+// from stateDir to avoid suggesting them, but it is never created or written.
+func withDriver(ctx *cli.Context, stateDir string, fn func(d *driver.Driver) error) error {
+	log.SetLevel(log.ErrorLevel)
+	if ctx.GlobalBool("debug") {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	quit := make(chan struct{})
+	d, err := driver.NewDriver(quit, &driver.Options{
+		StateDir:     stateDir,
+		ReadOnly:     true,
+		Probe:        ctx.String("probe"),
+		ProbeTimeout: ctx.Duration("timeout"),
+	})
+	if err != nil {
+		return err
+	}
+
+	dErrCh := make(chan error)
+	go func() {
+		dErrCh <- d.StartProbing()
+	}()
+	fErrCh := make(chan error)
+	go func() {
+		fErrCh <- fn(d)
+	}()
+
+	select {
+	case err = <-fErrCh:
+		close(quit)
+		if dErr := <-dErrCh; err == nil {
+			err = dErr
+		}
+	case err = <-dErrCh:
+		if err == nil {
+			err = fmt.Errorf("driver stopped unexpectedly")
+		}
+	}
+	return err
+}
@@ -1,6 +1,8 @@
 package driver
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"syscall"
@@ -14,20 +16,43 @@ import (
 
 const neighChanLen = 256
 
-func (d *Driver) tryAddress(addr *net.IPNet, to time.Duration) error {
-	r, err := d.ns.probeAndWait(addr, to)
+// tryAddress leases addr, returning an error if it can't be allocated. An
+// address in use by mac, the requesting endpoint, is not considered in use,
+// nor is one already allocated to it, as when a release was missed.
+// specific is true if the endpoint asked for addr, a reserved address is then
+// allowed if the pool forces it.
+func (d *Driver) tryAddress(ctx context.Context, p *pool, addr *net.IPNet, specific bool, mac net.HardwareAddr) error {
+	if d.isReserved(p, addr.IP) && !(specific && p.cfg.force.contains(addr.IP)) {
+		return fmt.Errorf("Address is reserved: %v", addr)
+	}
+	if a := d.ledger.get(p.id(), addr.IP); a != nil && (mac == nil || !bytes.Equal(requestMAC(a.Options), mac)) {
+		return fmt.Errorf("Address already allocated: %v", addr)
+	}
+	if !d.leases.take(p.id(), addr.IP, p.cfg.requestTimeout) {
+		return fmt.Errorf("Address is being allocated: %v", addr)
+	}
+	r, err := probeExcept(ctx, p.cfg.prober, addr, p.cfg.probeTimeout, mac)
 	if err != nil {
+		d.leases.drop(p.id(), addr.IP)
 		log.WithError(err).Error("Error determining if addr is reachable")
 		return err
 	}
 	if r {
+		d.leases.drop(p.id(), addr.IP)
 		return fmt.Errorf("Address already in use: %v", addr)
 	}
 	return nil
 }
 
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
 func getNeigh(addr net.IP) (*netlink.Neigh, error) {
-	neighList, err := netlink.NeighList(0, netlink.FAMILY_V4)
+	neighList, err := netlink.NeighList(0, ipFamily(addr))
 	if err != nil {
 		log.WithError(err).Error("Error refreshing neighbor table.")
 		return nil, err
@@ -40,12 +65,13 @@ func getNeigh(addr net.IP) (*netlink.Neigh, error) {
 	return nil, nil
 }
 
-func (ns *neighSubscription) addrStatus(addr net.IP) (known, reachable bool) {
+func (ns *neighSubscription) addrStatus(addr net.IP) (n *netlink.Neigh, known, reachable bool) {
 	n, err := getNeigh(addr)
 	if err != nil {
 		return
 	}
-	return parseAddrStatus(n)
+	known, reachable = parseAddrStatus(n)
+	return
 }
 
 func parseAddrStatus(n *netlink.Neigh) (known, reachable bool) {
@@ -60,6 +86,7 @@ func parseAddrStatus(n *netlink.Neigh) (known, reachable bool) {
 type neighSubscription struct {
 	quit     <-chan struct{}
 	addSubCh chan *subscription
+	listCh   chan chan []*subscription
 }
 
 type subscription struct {
@@ -77,10 +104,16 @@ func (e *probeTimeoutError) Error() string {
 	return e.err
 }
 
-func (ns *neighSubscription) probeAndWait(addr *net.IPNet, to time.Duration) (reachable bool, err error) {
+func (ns *neighSubscription) probeAndWait(ctx context.Context, addr *net.IPNet, to time.Duration) (reachable bool, err error) {
 	var known bool
-	known, reachable = ns.addrStatus(addr.IP)
+	var n *netlink.Neigh
+	state := probeTimeout
+	defer func() {
+		neighProbeStates.WithLabelValues(state).Inc()
+	}()
+	n, known, reachable = ns.addrStatus(addr.IP)
 	if known {
+		state = neighStateName(n)
 		return
 	}
 
@@ -88,23 +121,32 @@ func (ns *neighSubscription) probeAndWait(addr *net.IPNet, to time.Duration) (re
 	startTime := time.Now()
 	stopTime := startTime.Add(to)
 	defer t.Stop()
-	sub := ns.addSub(addr)
+	sub, err := ns.addSub(addr)
+	if err != nil {
+		state = probeCancelled
+		return false, err
+	}
 	defer sub.delSub()
 
 	for {
 		probe(addr.IP)
 		select {
+		case <-ctx.Done():
+			state = probeCancelled
+			return false, ctx.Err()
 		case <-ns.quit:
-			return
+			return false, errShuttingDown
 		case n := <-sub.sub:
 			known, reachable = parseAddrStatus(n)
 			if known {
+				state = neighStateName(n)
 				return reachable, nil
 			}
 		case <-t.C:
 		}
-		known, reachable = ns.addrStatus(addr.IP)
+		n, known, reachable = ns.addrStatus(addr.IP)
 		if known {
+			state = neighStateName(n)
 			return reachable, nil
 		}
 		if time.Now().After(stopTime) {
@@ -118,11 +160,13 @@ func (ns *neighSubscription) probeAndWait(addr *net.IPNet, to time.Duration) (re
 			l = l.WithField("neigh", n)
 			known, reachable = parseAddrStatus(n)
 			if known {
+				state = neighStateName(n)
 				l.Debug("Reachability determined after timeout.")
 				return reachable, nil
 			}
 			// If we've waited 8 seconds, consider incomplete to be known
 			if n == nil || n.State == netlink.NUD_INCOMPLETE {
+				state = neighStateName(n)
 				l.Debug("Incomplete assumed non-reachable after timeout.")
 				return false, nil
 			}
@@ -132,15 +176,21 @@ func (ns *neighSubscription) probeAndWait(addr *net.IPNet, to time.Duration) (re
 	}
 }
 
-func (ns *neighSubscription) addSub(ip *net.IPNet) *subscription {
+// addSub subscribes to neighbor updates for ip. It fails once quit is closed,
+// requests may still be finishing after the subscriptions have stopped.
+func (ns *neighSubscription) addSub(ip *net.IPNet) (*subscription, error) {
 	sub := &subscription{
 		ip:      ip,
 		created: time.Now(),
 		sub:     make(chan *netlink.Neigh, neighChanLen),
 		close:   make(chan struct{}),
 	}
-	ns.addSubCh <- sub
-	return sub
+	select {
+	case ns.addSubCh <- sub:
+		return sub, nil
+	case <-ns.quit:
+		return nil, errShuttingDown
+	}
 }
 
 func (sub *subscription) delSub() {
@@ -156,13 +206,24 @@ func newNeighSubscription(quit <-chan struct{}) *neighSubscription {
 	ns := &neighSubscription{
 		quit:     quit,
 		addSubCh: make(chan *subscription),
+		listCh:   make(chan chan []*subscription),
 	}
 	return ns
 }
 
+// subscriptions returns the active subscriptions
+func (ns *neighSubscription) subscriptions() []*subscription {
+	lc := make(chan []*subscription)
+	select {
+	case ns.listCh <- lc:
+		return <-lc
+	case <-ns.quit:
+		return nil
+	}
+}
+
 func (ns *neighSubscription) start() error {
 	quit := ns.quit
-	defer close(ns.addSubCh)
 	wg := sync.WaitGroup{}
 
 	s, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_NEIGH)
@@ -170,17 +231,19 @@ func (ns *neighSubscription) start() error {
 		return err
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		<-quit
+	// Wake up periodically to check for quit, closing the socket doesn't
+	// interrupt a receive in progress
+	tv := syscall.NsecToTimeval(time.Second.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(s.GetFd(), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
 		s.Close()
-	}()
+		return err
+	}
 
 	neighSubCh := make(chan []*neighUpdate, neighChanLen)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		defer s.Close()
 		for {
 			for {
 				msgs, err := s.Receive()
@@ -190,6 +253,9 @@ func (ns *neighSubscription) start() error {
 				default:
 				}
 
+				if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+					continue
+				}
 				if err != nil {
 					log.WithError(err).Error("Error recieving neighbor update")
 				}
@@ -202,6 +268,10 @@ func (ns *neighSubscription) start() error {
 							log.Errorf("Error deserializing neighbor message %v", m.Data)
 							continue
 						}
+						// A deleted entry keeps its last state, it is gone
+						if m.Header.Type == syscall.RTM_DELNEIGH {
+							n.State = netlink.NUD_NONE
+						}
 						ns = append(ns, &neighUpdate{
 							time:  t,
 							neigh: n,
@@ -223,6 +293,18 @@ func (ns *neighSubscription) start() error {
 				return
 			case sub := <-ns.addSubCh:
 				subs[sub.ip.String()] = append(subs[sub.ip.String()], sub)
+			case lc := <-ns.listCh:
+				var l []*subscription
+				for _, s := range subs {
+					for _, sub := range s {
+						select {
+						case <-sub.close:
+						default:
+							l = append(l, sub)
+						}
+					}
+				}
+				lc <- l
 			case neighList := <-neighSubCh:
 				for _, n := range neighList {
 					subs[n.neigh.IP.String()] = sendNeighUpdates(n.neigh, subs[n.neigh.IP.String()])
@@ -232,6 +314,7 @@ func (ns *neighSubscription) start() error {
 				}
 			}
 			// cleanup
+			active := 0
 			for ip, s := range subs {
 				l := len(s)
 				for i := range s {
@@ -249,7 +332,9 @@ func (ns *neighSubscription) start() error {
 				if len(s) == 0 {
 					delete(subs, ip)
 				}
+				active += len(s)
 			}
+			activeSubscriptions.Set(float64(active))
 		}
 	}()
 
@@ -277,8 +362,15 @@ func sendNeighUpdates(n *netlink.Neigh, subs []*subscription) []*subscription {
 	return subs
 }
 
+// probe kicks the kernel into resolving ip. For IPv6 a neighbor solicitation is
+// sent as well, since the kernel may wait on its own retransmit timer.
 func probe(ip net.IP) {
-	conn, err := net.Dial("udp", ip.String()+":8765")
+	if ip.To4() == nil {
+		if err := sendNeighborSolicitation(ip); err != nil {
+			log.WithError(err).WithField("ip", ip).Error("Error sending neighbor solicitation.")
+		}
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "8765"))
 	if err != nil {
 		log.WithError(err).WithField("ip", ip).Error("Error creating probe connection.")
 		return
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddSubAfterQuit(t *testing.T) {
+	quit := make(chan struct{})
+	ns := newNeighSubscription(quit)
+	close(quit)
+
+	// Requests finishing after the subscriptions stopped must fail, not block
+	res := make(chan error)
+	go func() {
+		_, err := ns.addSub(&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)})
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		if err != errShuttingDown {
+			t.Errorf("Subscribing after quit: %v, want %v", err, errShuttingDown)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribing after quit blocked")
+	}
+}
+
+func TestTryAddressReserved(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	c := testConfig()
+	c.prober = freeProber{}
+	var err error
+	if c.reserved, err = parseRanges("10.0.0.1-10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if c.force, err = parseRanges("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	d, p, _ := testCandidates(t, quit, "10.0.0.0/29", c)
+	for _, tc := range []struct {
+		ip       string
+		specific bool
+		ok       bool
+	}{
+		{"10.0.0.1", true, false},
+		{"10.0.0.2", true, true},
+		{"10.0.0.2", false, false},
+		{"10.0.0.4", false, true},
+	} {
+		addr := &net.IPNet{IP: net.ParseIP(tc.ip), Mask: p.Mask}
+		err := d.tryAddress(context.Background(), p, addr, tc.specific, nil)
+		if (err == nil) != tc.ok {
+			t.Errorf("Try %v, specific %v: %v", tc.ip, tc.specific, err)
+		}
+		d.leases.drop(p.id(), addr.IP)
+	}
+}
+
+func TestTryAddressAllocatedToMAC(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	c := testConfig()
+	c.prober = freeProber{}
+	d, p, _ := testCandidates(t, quit, "10.0.0.0/29", c)
+	ip := net.ParseIP("10.0.0.2")
+	mac := "02:00:00:00:00:01"
+	if err := d.ledger.add(p.id(), ip, map[string]string{optMACAddress: mac}); err != nil {
+		t.Fatal(err)
+	}
+	// A release the driver never got leaves the endpoint's address allocated
+	for _, tc := range []struct {
+		mac string
+		ok  bool
+	}{
+		{mac, true},
+		{"02:00:00:00:00:02", false},
+		{"", false},
+	} {
+		addr := &net.IPNet{IP: ip, Mask: p.Mask}
+		err := d.tryAddress(context.Background(), p, addr, true, requestMAC(map[string]string{optMACAddress: tc.mac}))
+		if (err == nil) != tc.ok {
+			t.Errorf("Try allocated address from MAC %q: %v", tc.mac, err)
+		}
+		d.leases.drop(p.id(), addr.IP)
+	}
+}
@@ -0,0 +1,300 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/ipam"
+)
+
+type poolInfo struct {
+	ID               string   `json:"id"`
+	Space            string   `json:"space"`
+	Pool             string   `json:"pool"`
+	SubPool          string   `json:"subPool,omitempty"`
+	Probe            string   `json:"probe"`
+	ExcludeFirst     int      `json:"excludeFirst"`
+	ExcludeLast      int      `json:"excludeLast"`
+	Exclude          []string `json:"exclude,omitempty"`
+	Reserved         []string `json:"reserved,omitempty"`
+	Force            []string `json:"force,omitempty"`
+	ProbeTimeout     string   `json:"probeTimeout"`
+	CandidateTimeout string   `json:"candidateTimeout"`
+	RequestTimeout   string   `json:"requestTimeout"`
+	Candidates       int      `json:"candidates"`
+	Allocations      int      `json:"allocations"`
+}
+
+type neighInfo struct {
+	State        string `json:"state"`
+	HardwareAddr string `json:"hardwareAddr,omitempty"`
+	LinkIndex    int    `json:"linkIndex"`
+}
+
+type addressInfo struct {
+	Address       string        `json:"address"`
+	Known         bool          `json:"known"`
+	Reachable     bool          `json:"reachable"`
+	Neighbor      *neighInfo    `json:"neighbor,omitempty"`
+	Allocations   []*allocation `json:"allocations,omitempty"`
+	Reserved      bool          `json:"reserved"`
+	Quarantined   []string      `json:"quarantined,omitempty"` // pools the address is quarantined in
+	Subscriptions int           `json:"subscriptions"`
+}
+
+type subscriptionInfo struct {
+	Address string    `json:"address"`
+	Created time.Time `json:"created"`
+}
+
+type probeResult struct {
+	Address   string `json:"address"`
+	Reachable bool   `json:"reachable"`
+}
+
+// AdminHandler returns a handler serving the admin API. Pool IDs in paths may
+// be given as is or url escaped.
+//
+//	GET    /pools                       pools and their config
+//	GET    /pools/{id}/candidates       candidate addresses held for a pool
+//	POST   /pools/{id}/probe?address=ip probe an address with the pool's probe method
+//	DELETE /pools/{id}/addresses/{ip}   release an allocation docker never released, refused
+//	                                    if the address answers a probe unless ?force=true
+//	GET    /addresses/{ip}              neighbor, allocation and subscription state of an address in every pool
+//	GET    /subscriptions               active neighbor subscriptions
+func (d *Driver) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pools", d.adminPools)
+	mux.HandleFunc("/pools/", d.adminPool)
+	mux.HandleFunc("/addresses/", d.adminAddress)
+	mux.HandleFunc("/subscriptions", d.adminSubscriptions)
+	return mux
+}
+
+func (d *Driver) adminPools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+	counts := d.ledger.poolCounts()
+	d.poolLock.Lock()
+	pools := make([]*poolInfo, 0, len(d.pools))
+	for id, c := range d.pools {
+		pi := &poolInfo{
+			ID:               id,
+			Probe:            c.probe,
+			ExcludeFirst:     c.excludeFirst,
+			ExcludeLast:      c.excludeLast,
+			Exclude:          c.exclude.strings(),
+			Reserved:         c.reserved.strings(),
+			Force:            c.force.strings(),
+			ProbeTimeout:     c.probeTimeout.String(),
+			CandidateTimeout: c.candidateTimeout.String(),
+			RequestTimeout:   c.requestTimeout.String(),
+			Candidates:       c.candidates,
+			Allocations:      counts[id],
+		}
+		if p, err := parsePoolID(id); err == nil {
+			pi.Space = p.space
+			pi.Pool = p.IPNet.String()
+			if p.sub != nil {
+				pi.SubPool = p.sub.String()
+			}
+		}
+		pools = append(pools, pi)
+	}
+	d.poolLock.Unlock()
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+	writeJSON(w, pools)
+}
+
+func (d *Driver) adminPool(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/pools/")
+	switch {
+	case strings.Contains(rest, "/addresses/"):
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+			return
+		}
+		i := strings.LastIndex(rest, "/addresses/")
+		d.adminRelease(r.Context(), w, rest[:i], rest[i+len("/addresses/"):], r.URL.Query().Get("force") == "true")
+	case strings.HasSuffix(rest, "/candidates"):
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+			return
+		}
+		d.adminCandidates(w, strings.TrimSuffix(rest, "/candidates"))
+	case strings.HasSuffix(rest, "/probe"):
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+			return
+		}
+		d.adminProbe(r.Context(), w, strings.TrimSuffix(rest, "/probe"), r.URL.Query().Get("address"))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found"))
+	}
+}
+
+func (d *Driver) adminCandidates(w http.ResponseWriter, id string) {
+	cl := d.candidates.get(id)
+	if cl == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No candidates for pool %v", id))
+		return
+	}
+	candidates := []string{}
+	for _, c := range cl.list() {
+		candidates = append(candidates, c.IP.String())
+	}
+	writeJSON(w, candidates)
+}
+
+func (d *Driver) adminProbe(ctx context.Context, w http.ResponseWriter, id, address string) {
+	d.poolLock.Lock()
+	c, ok := d.pools[id]
+	d.poolLock.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown pool %v", id))
+		return
+	}
+	p, err := parsePoolID(id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p.cfg = c
+	ip := net.ParseIP(address)
+	if ip == nil || !p.Contains(ip) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Address %q is not in pool %v", address, id))
+		return
+	}
+	addr := &net.IPNet{IP: ip, Mask: p.Mask}
+	reachable, err := c.prober.Probe(ctx, addr, c.probeTimeout)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if _, ok := err.(*probeTimeoutError); ok {
+			code = http.StatusGatewayTimeout
+		}
+		writeError(w, code, err)
+		return
+	}
+	writeJSON(w, &probeResult{Address: ip.String(), Reachable: reachable})
+}
+
+// adminRelease releases an allocation left in the ledger by a release docker
+// never sent, as after a crash. An address still answering probes is likely in
+// use, so it is only released if forced.
+func (d *Driver) adminRelease(ctx context.Context, w http.ResponseWriter, id, address string, force bool) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Unable to parse address"))
+		return
+	}
+	a := d.ledger.get(id, ip)
+	if a == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Address %v is not allocated in pool %v", ip, id))
+		return
+	}
+	if !force {
+		p, err := d.getPool(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		reachable, err := p.cfg.prober.Probe(ctx, &net.IPNet{IP: ip, Mask: p.Mask}, p.cfg.probeTimeout)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if _, ok := err.(*probeTimeoutError); ok {
+				code = http.StatusGatewayTimeout
+			}
+			writeError(w, code, err)
+			return
+		}
+		if reachable {
+			writeError(w, http.StatusConflict, fmt.Errorf("Address %v is in use, force to release it anyway", ip))
+			return
+		}
+	}
+	log.WithField("pool", id).WithField("ip", ip).WithField("force", force).Info("Releasing allocation from the admin API")
+	if err := d.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: id, Address: ip.String()}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, a)
+}
+
+func (d *Driver) adminAddress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+	ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/addresses/"))
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Unable to parse address"))
+		return
+	}
+	n, known, reachable := d.ns.addrStatus(ip)
+	ai := &addressInfo{
+		Address:     ip.String(),
+		Known:       known,
+		Reachable:   reachable,
+		Allocations: d.ledger.find(ip),
+		Reserved:    d.globalReserved(ip),
+	}
+	d.poolLock.Lock()
+	for id := range d.pools {
+		if d.ledger.quarantined(id, ip) {
+			ai.Quarantined = append(ai.Quarantined, id)
+		}
+	}
+	d.poolLock.Unlock()
+	if n != nil {
+		ai.Neighbor = &neighInfo{
+			State:     neighStateName(n),
+			LinkIndex: n.LinkIndex,
+		}
+		if n.HardwareAddr != nil {
+			ai.Neighbor.HardwareAddr = n.HardwareAddr.String()
+		}
+	}
+	for _, s := range d.ns.subscriptions() {
+		if s.ip.IP.Equal(ip) {
+			ai.Subscriptions++
+		}
+	}
+	writeJSON(w, ai)
+}
+
+func (d *Driver) adminSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+	subs := []*subscriptionInfo{}
+	for _, s := range d.ns.subscriptions() {
+		subs = append(subs, &subscriptionInfo{Address: s.ip.IP.String(), Created: s.created})
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Created.Before(subs[j].Created) })
+	writeJSON(w, subs)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Error writing admin response")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}); err != nil {
+		log.WithError(err).Error("Error writing admin response")
+	}
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRelease(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	c := testConfig()
+	c.prober = &fakeProber{}
+	d, p, _ := testCandidates(t, quit, "10.0.0.0/24", c)
+	d.pools = map[string]*poolConfig{p.id(): p.cfg}
+	d.conflicts = &conflictMonitors{monitors: make(map[string]chan struct{})}
+	ip := net.ParseIP("10.0.0.5")
+	if err := d.ledger.add(p.id(), ip, nil); err != nil {
+		t.Fatal(err)
+	}
+	h := d.AdminHandler()
+	release := func(query string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/pools/"+p.id()+"/addresses/"+ip.String()+query, nil))
+		return w.Code
+	}
+
+	// The address still answers, so it is likely in use
+	if code := release(""); code != http.StatusConflict {
+		t.Errorf("Releasing an address in use: %v, want %v", code, http.StatusConflict)
+	}
+	if d.ledger.get(p.id(), ip) == nil {
+		t.Fatal("Address in use was released")
+	}
+	p.cfg.prober = freeProber{}
+	if code := release(""); code != http.StatusOK {
+		t.Errorf("Releasing a free address: %v, want %v", code, http.StatusOK)
+	}
+	if d.ledger.get(p.id(), ip) != nil {
+		t.Error("Free address still allocated")
+	}
+	if code := release(""); code != http.StatusNotFound {
+		t.Errorf("Releasing an unallocated address: %v, want %v", code, http.StatusNotFound)
+	}
+
+	p.cfg.prober = &fakeProber{}
+	if err := d.ledger.add(p.id(), ip, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code := release("?force=true"); code != http.StatusOK {
+		t.Errorf("Forcing release of an address in use: %v, want %v", code, http.StatusOK)
+	}
+	if d.ledger.get(p.id(), ip) != nil {
+		t.Error("Forced address still allocated")
+	}
+}
@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// RFC 5227 announcement timing
+const (
+	announceNum      = 2
+	announceInterval = 2 * time.Second
+)
+
+// announceTimeout is how long to wait for an endpoint to appear after its
+// address is allocated
+const announceTimeout = 2 * time.Minute
+
+// flushNeigh deletes any neighbor entry for ip, so the host resolves it again
+// instead of using a stale entry
+func flushNeigh(ip net.IP) error {
+	neighs, err := netlink.NeighList(0, ipFamily(ip))
+	if err != nil {
+		log.WithError(err).Error("Failed to get arp table")
+		return err
+	}
+	for _, n := range neighs {
+		if ip.Equal(n.IP) {
+			log.Debugf("Deleting entry from arp table for %v", ip)
+			err := netlink.NeighDel(&n)
+			if err != nil {
+				log.WithError(err).WithField("ip", ip).Error("Failed to delete arp entry.")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// resolved returns true if n is a neighbor entry with a usable link layer address
+func resolved(n *netlink.Neigh) bool {
+	if n == nil || len(n.HardwareAddr) == 0 {
+		return false
+	}
+	return n.State&(netlink.NUD_REACHABLE|netlink.NUD_STALE|netlink.NUD_DELAY|netlink.NUD_PROBE|netlink.NUD_PERMANENT) != 0
+}
+
+// announce waits for the endpoint using addr to appear on the network, then
+// announces its address so neighbors with stale entries update them. mac is
+// the endpoint's MAC if known. Nothing is announced if the address resolves to
+// another MAC, so a conflicting host is never advertised.
+func (d *Driver) announce(addr *net.IPNet, mac net.HardwareAddr) {
+	l := log.WithField("ip", addr.IP)
+	sub, err := d.ns.addSub(addr)
+	if err != nil {
+		return
+	}
+	defer sub.delSub()
+	t := time.NewTicker(probeInterval)
+	defer t.Stop()
+	done := time.NewTimer(announceTimeout)
+	defer done.Stop()
+
+	for {
+		n, err := getNeigh(addr.IP)
+		if err != nil {
+			return
+		}
+		if resolved(n) {
+			if mac == nil {
+				mac = n.HardwareAddr
+			} else if !bytes.Equal(n.HardwareAddr, mac) {
+				l.WithField("mac", n.HardwareAddr).WithField("endpoint", mac).Warn("Address resolves to a MAC other than its endpoint's, not announcing")
+				return
+			}
+			break
+		}
+		probe(addr.IP)
+		select {
+		case <-sub.sub:
+		case <-t.C:
+		case <-done.C:
+			l.Debug("Endpoint did not appear, not announcing")
+			return
+		case <-d.quit:
+			return
+		}
+	}
+
+	l = l.WithField("mac", mac)
+	for i := 0; i < announceNum; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(announceInterval):
+			case <-d.quit:
+				return
+			}
+		}
+		var err error
+		if addr.IP.To4() != nil {
+			err = d.sendGratuitousARP(addr.IP, mac)
+		} else {
+			err = sendUnsolicitedNA(addr.IP, mac)
+		}
+		if err != nil {
+			l.WithError(err).Error("Error announcing address")
+			return
+		}
+		l.Debug("Announced address")
+	}
+}
+
+// sendGratuitousARP broadcasts an RFC 5227 announcement that ip is at mac. The
+// ethernet header is sent from the host link, only the arp payload carries mac.
+func (d *Driver) sendGratuitousARP(ip net.IP, mac net.HardwareAddr) error {
+	l, _, err := d.arpListeners.get(ip)
+	if err != nil {
+		return err
+	}
+	return l.conn.send(&arpPacket{
+		op:        arpRequest,
+		senderMAC: mac,
+		senderIP:  ip,
+		targetMAC: make(net.HardwareAddr, 6),
+		targetIP:  ip,
+	})
+}
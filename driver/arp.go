@@ -0,0 +1,398 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	arpRequest = 1
+	arpReply   = 2
+	arpLen     = 28
+)
+
+// RFC 5227 timing
+const (
+	dadProbeNum     = 3
+	dadAnnounceWait = 2 * time.Second
+)
+
+// Requests are retried quickly, a host on the local link will answer well
+// within the retry interval if it exists at all
+const (
+	arpRetries       = 3
+	arpRetryInterval = 150 * time.Millisecond
+	arpWaiterLen     = 16
+)
+
+var ethBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+type arpPacket struct {
+	op        uint16
+	senderMAC net.HardwareAddr
+	senderIP  net.IP
+	targetMAC net.HardwareAddr
+	targetIP  net.IP
+}
+
+func (p *arpPacket) marshal() []byte {
+	b := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(b[0:2], 1) // ethernet
+	binary.BigEndian.PutUint16(b[2:4], syscall.ETH_P_IP)
+	b[4] = 6
+	b[5] = 4
+	binary.BigEndian.PutUint16(b[6:8], p.op)
+	copy(b[8:14], p.senderMAC)
+	copy(b[14:18], p.senderIP.To4())
+	copy(b[18:24], p.targetMAC)
+	copy(b[24:28], p.targetIP.To4())
+	return b
+}
+
+// parseARP parses an arp packet, copying out of b so it can be reused
+func parseARP(b []byte) (*arpPacket, error) {
+	if len(b) < arpLen {
+		return nil, fmt.Errorf("Short arp packet: %v bytes", len(b))
+	}
+	if binary.BigEndian.Uint16(b[2:4]) != syscall.ETH_P_IP || b[4] != 6 || b[5] != 4 {
+		return nil, fmt.Errorf("Not an ethernet/ipv4 arp packet")
+	}
+	b = append([]byte(nil), b[:arpLen]...)
+	return &arpPacket{
+		op:        binary.BigEndian.Uint16(b[6:8]),
+		senderMAC: net.HardwareAddr(b[8:14]),
+		senderIP:  net.IP(b[14:18]),
+		targetMAC: net.HardwareAddr(b[18:24]),
+		targetIP:  net.IP(b[24:28]),
+	}, nil
+}
+
+// arpConn is a packet socket sending and receiving arp on a single link
+type arpConn struct {
+	fd      int
+	ifIndex int
+	mac     net.HardwareAddr
+}
+
+func openARPConn(ifIndex int, mac net.HardwareAddr) (*arpConn, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return nil, err
+	}
+	c := &arpConn{
+		fd:      fd,
+		ifIndex: ifIndex,
+		mac:     mac,
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  c.ifIndex,
+	}); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *arpConn) close() {
+	if err := syscall.Close(c.fd); err != nil {
+		log.WithError(err).Error("Error closing arp socket")
+	}
+}
+
+// send broadcasts an arp packet on the link
+func (c *arpConn) send(p *arpPacket) error {
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  c.ifIndex,
+		Halen:    6,
+	}
+	copy(sa.Addr[:], ethBroadcast)
+	return syscall.Sendto(c.fd, p.marshal(), 0, sa)
+}
+
+// arpListeners holds one listener for each link arp is probed on
+type arpListeners struct {
+	lock  sync.Mutex
+	links map[int]*arpListener
+	quit  <-chan struct{}
+}
+
+func newARPListeners(quit <-chan struct{}) *arpListeners {
+	return &arpListeners{
+		links: make(map[int]*arpListener),
+		quit:  quit,
+	}
+}
+
+// arpListener reads all arp on a link and hands packets to anyone watching
+// the addresses in them. dead is closed with err set if the listener stops, so
+// watchers don't mistake silence for a free address.
+type arpListener struct {
+	conn    *arpConn
+	lock    sync.Mutex
+	waiters map[string][]chan *arpPacket
+	dead    chan struct{}
+	err     error
+}
+
+// get returns the listener for the local link in the same network as ip, and
+// the local address to send requests from
+func (al *arpListeners) get(ip net.IP) (*arpListener, net.IP, error) {
+	link, local, err := localLink(ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if l, ok := al.links[link.Attrs().Index]; ok {
+		return l, local.IP.To4(), nil
+	}
+
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return nil, nil, fmt.Errorf("Link %v has no ethernet address", link.Attrs().Name)
+	}
+	c, err := openARPConn(link.Attrs().Index, mac)
+	if err != nil {
+		log.WithError(err).WithField("link", link.Attrs().Name).Error("Error opening arp socket")
+		return nil, nil, err
+	}
+	l := &arpListener{
+		conn:    c,
+		waiters: make(map[string][]chan *arpPacket),
+		dead:    make(chan struct{}),
+	}
+	al.links[c.ifIndex] = l
+	go func() {
+		err := l.run(al.quit)
+		// Remove the listener before failing it, so watchers see a new one on get
+		al.lock.Lock()
+		delete(al.links, c.ifIndex)
+		al.lock.Unlock()
+		l.err = err
+		close(l.dead)
+	}()
+	return l, local.IP.To4(), nil
+}
+
+func (l *arpListener) run(quit <-chan struct{}) error {
+	defer l.conn.close()
+	buf := make([]byte, 128)
+	for {
+		select {
+		case <-quit:
+			return errShuttingDown
+		default:
+		}
+		// Wake up periodically to check for quit
+		n, _, err := recvDeadline(l.conn.fd, buf, time.Now().Add(1*time.Second))
+		if err == errRecvTimeout {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("link", l.conn.ifIndex).Error("Error receiving arp, closing listener")
+			return fmt.Errorf("Arp listener on link %v stopped: %v", l.conn.ifIndex, err)
+		}
+		p, err := parseARP(buf[:n])
+		if err != nil {
+			log.WithError(err).Debug("Ignoring packet")
+			continue
+		}
+		l.dispatch(p.senderIP, p)
+		if !p.targetIP.Equal(p.senderIP) {
+			l.dispatch(p.targetIP, p)
+		}
+	}
+}
+
+func (l *arpListener) dispatch(ip net.IP, p *arpPacket) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, w := range l.waiters[ip.String()] {
+		select {
+		case w <- p:
+		default:
+			log.WithField("ip", ip).Debug("Arp waiter full, dropping packet")
+		}
+	}
+}
+
+// watch returns a channel receiving all arp to or from ip and a function to
+// stop watching
+func (l *arpListener) watch(ip net.IP) (<-chan *arpPacket, func()) {
+	w := make(chan *arpPacket, arpWaiterLen)
+	k := ip.String()
+	l.lock.Lock()
+	l.waiters[k] = append(l.waiters[k], w)
+	l.lock.Unlock()
+	return w, func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		ws := l.waiters[k]
+		for i := range ws {
+			if ws[i] == w {
+				ws = append(ws[:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(ws) == 0 {
+			delete(l.waiters, k)
+			return
+		}
+		l.waiters[k] = ws
+	}
+}
+
+// arpProber sends arp requests directly from the link owning the pool and
+// waits for a reply. The kernel neighbor table is not consulted, a host that
+// has not answered after a few quick retries is considered absent.
+type arpProber struct {
+	listeners *arpListeners
+	v6        Prober
+}
+
+func (p *arpProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	return p.ProbeExcept(ctx, addr, to, nil)
+}
+
+func (p *arpProber) ProbeExcept(ctx context.Context, addr *net.IPNet, to time.Duration, mac net.HardwareAddr) (bool, error) {
+	if addr.IP.To4() == nil {
+		return probeExcept(ctx, p.v6, addr, to, mac)
+	}
+	l, local, err := p.listeners.get(addr.IP)
+	if err != nil {
+		return false, err
+	}
+	replies, stop := l.watch(addr.IP)
+	defer stop()
+
+	req := &arpPacket{
+		op:        arpRequest,
+		senderMAC: l.conn.mac,
+		senderIP:  local,
+		targetMAC: make(net.HardwareAddr, 6),
+		targetIP:  addr.IP,
+	}
+	timeout := time.NewTimer(to)
+	defer timeout.Stop()
+	retry := time.NewTicker(arpRetryInterval)
+	defer retry.Stop()
+	if err := l.conn.send(req); err != nil {
+		return false, err
+	}
+	sent := 1
+	for {
+		select {
+		case r := <-replies:
+			if r.op == arpReply && r.senderIP.Equal(addr.IP) {
+				if mac != nil && bytes.Equal(r.senderMAC, mac) {
+					log.WithField("ip", addr.IP).WithField("mac", r.senderMAC).Debug("Arp reply from requesting MAC ignored")
+					continue
+				}
+				log.WithField("ip", addr.IP).WithField("mac", r.senderMAC).Debug("Arp reply received")
+				return true, nil
+			}
+		case <-retry.C:
+			if sent >= arpRetries {
+				return false, nil
+			}
+			if err := l.conn.send(req); err != nil {
+				return false, err
+			}
+			sent++
+		case <-timeout.C:
+			return false, nil
+		case <-l.dead:
+			return false, l.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-p.listeners.quit:
+			return false, errShuttingDown
+		}
+	}
+}
+
+// dadProber performs RFC 5227 address conflict detection, sending arp probes
+// with a sender address of 0.0.0.0 so no neighbor caches are poisoned
+type dadProber struct {
+	listeners *arpListeners
+	v6        Prober
+}
+
+func (p *dadProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	return p.ProbeExcept(ctx, addr, to, nil)
+}
+
+func (p *dadProber) ProbeExcept(ctx context.Context, addr *net.IPNet, to time.Duration, mac net.HardwareAddr) (bool, error) {
+	if addr.IP.To4() == nil {
+		return probeExcept(ctx, p.v6, addr, to, mac)
+	}
+	l, _, err := p.listeners.get(addr.IP)
+	if err != nil {
+		return false, err
+	}
+	pkts, stop := l.watch(addr.IP)
+	defer stop()
+
+	req := &arpPacket{
+		op:        arpRequest,
+		senderMAC: l.conn.mac,
+		senderIP:  net.IPv4zero,
+		targetMAC: make(net.HardwareAddr, 6),
+		targetIP:  addr.IP,
+	}
+	wait := dadProbeNum*probeInterval + dadAnnounceWait
+	if to < wait {
+		wait = to
+	}
+	done := time.NewTimer(wait)
+	defer done.Stop()
+	t := time.NewTicker(probeInterval)
+	defer t.Stop()
+	if err := l.conn.send(req); err != nil {
+		return false, err
+	}
+	sent := 1
+	for {
+		select {
+		case r := <-pkts:
+			if mac != nil && bytes.Equal(r.senderMAC, mac) {
+				continue
+			}
+			// Any arp from the address is a conflict
+			if r.senderIP.Equal(addr.IP) {
+				log.WithField("ip", addr.IP).WithField("mac", r.senderMAC).Debug("Address conflict detected")
+				return true, nil
+			}
+			// So is another host probing for the same address
+			if r.op == arpRequest && r.senderIP.Equal(net.IPv4zero) && r.targetIP.Equal(addr.IP) && !bytes.Equal(r.senderMAC, l.conn.mac) {
+				log.WithField("ip", addr.IP).WithField("mac", r.senderMAC).Debug("Conflicting probe detected")
+				return true, nil
+			}
+		case <-t.C:
+			if sent < dadProbeNum {
+				if err := l.conn.send(req); err != nil {
+					return false, err
+				}
+				sent++
+			}
+		case <-done.C:
+			return false, nil
+		case <-l.dead:
+			return false, l.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-p.listeners.quit:
+			return false, errShuttingDown
+		}
+	}
+}
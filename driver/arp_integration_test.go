@@ -0,0 +1,165 @@
+//go:build integration
+// +build integration
+
+package driver
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	testVeth     = "arpipam0"
+	testVethPeer = "arpipam1"
+)
+
+// setupVeth creates a veth pair with the peer in its own network namespace.
+// The local end is 198.51.100.1/24 and the peer 198.51.100.2/24. It returns
+// the peer's MAC.
+func setupVeth(t *testing.T) (net.HardwareAddr, func()) {
+	if os.Getuid() != 0 {
+		t.Skip("Requires root")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	host, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	peerNs, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netns.Set(host); err != nil {
+		t.Fatal(err)
+	}
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: testVeth}, PeerName: testVethPeer}
+	if err := netlink.LinkAdd(veth); err != nil {
+		peerNs.Close()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		netlink.LinkDel(veth)
+		peerNs.Close()
+	}
+	fail := func(err error) {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	peer, err := netlink.LinkByName(testVethPeer)
+	if err != nil {
+		fail(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(peerNs)); err != nil {
+		fail(err)
+	}
+	local, err := netlink.LinkByName(testVeth)
+	if err != nil {
+		fail(err)
+	}
+	addr, _ := netlink.ParseAddr("198.51.100.1/24")
+	if err := netlink.AddrAdd(local, addr); err != nil {
+		fail(err)
+	}
+	if err := netlink.LinkSetUp(local); err != nil {
+		fail(err)
+	}
+
+	h, err := netlink.NewHandleAt(peerNs)
+	if err != nil {
+		fail(err)
+	}
+	defer h.Delete()
+	if peer, err = h.LinkByName(testVethPeer); err != nil {
+		fail(err)
+	}
+	addr, _ = netlink.ParseAddr("198.51.100.2/24")
+	if err := h.AddrAdd(peer, addr); err != nil {
+		fail(err)
+	}
+	if err := h.LinkSetUp(peer); err != nil {
+		fail(err)
+	}
+	return peer.Attrs().HardwareAddr, cleanup
+}
+
+func TestARPProbeVeth(t *testing.T) {
+	peerMAC, cleanup := setupVeth(t)
+	defer cleanup()
+
+	quit := make(chan struct{})
+	defer close(quit)
+	l := newARPListeners(quit)
+	probers := map[string]Prober{
+		ProbeARP: &arpProber{listeners: l},
+		ProbeDAD: &dadProber{listeners: l},
+	}
+	mask := net.CIDRMask(24, 32)
+	for name, p := range probers {
+		r, err := p.Probe(context.Background(), &net.IPNet{IP: net.ParseIP("198.51.100.2"), Mask: mask}, 5*time.Second)
+		if err != nil || !r {
+			t.Errorf("%v probe of peer: reachable %v, err %v", name, r, err)
+		}
+		r, err = p.Probe(context.Background(), &net.IPNet{IP: net.ParseIP("198.51.100.3"), Mask: mask}, 5*time.Second)
+		if err != nil || r {
+			t.Errorf("%v probe of unused address: reachable %v, err %v", name, r, err)
+		}
+		// The peer asking for its own address again doesn't find it in use
+		r, err = probeExcept(context.Background(), p, &net.IPNet{IP: net.ParseIP("198.51.100.2"), Mask: mask}, 5*time.Second, peerMAC)
+		if err != nil || r {
+			t.Errorf("%v probe of peer except its own MAC: reachable %v, err %v", name, r, err)
+		}
+	}
+}
+
+func TestARPListenerDeath(t *testing.T) {
+	_, cleanup := setupVeth(t)
+	defer cleanup()
+
+	quit := make(chan struct{})
+	defer close(quit)
+	al := newARPListeners(quit)
+	ip := net.ParseIP("198.51.100.3")
+	l, _, err := al.get(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A probe in progress when the listener dies must fail, not report free
+	res := make(chan error)
+	go func() {
+		_, err := (&dadProber{listeners: al}).Probe(context.Background(), &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}, 10*time.Second)
+		res <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: testVeth}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.dead:
+		if l.err == nil {
+			t.Error("Dead listener has no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listener still running after its link was deleted")
+	}
+	select {
+	case err := <-res:
+		if err == nil {
+			t.Error("Probe on a dead listener returned no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Probe still running after its listener died")
+	}
+}
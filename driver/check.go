@@ -0,0 +1,132 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// maxScanBits limits the size of a network which may be scanned
+const maxScanBits = 16
+
+// AddrState is the result of probing an address outside of docker
+type AddrState struct {
+	IP           net.IP
+	InUse        bool
+	Neighbor     string // neighbor table state after probing
+	HardwareAddr net.HardwareAddr
+	Err          error
+}
+
+// ProbeAddress probes ip with the default probe method and reports the
+// resulting neighbor table state
+func (d *Driver) ProbeAddress(ip net.IP) *AddrState {
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	c := d.defaultConfig()
+	return d.probeState(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, &c)
+}
+
+func (d *Driver) probeState(addr *net.IPNet, c *poolConfig) *AddrState {
+	s := &AddrState{IP: addr.IP}
+	s.InUse, s.Err = c.prober.Probe(context.Background(), addr, c.probeTimeout)
+	n, err := getNeigh(addr.IP)
+	if err != nil && s.Err == nil {
+		s.Err = err
+	}
+	s.Neighbor = neighStateName(n)
+	if n != nil {
+		s.HardwareAddr = n.HardwareAddr
+	}
+	return s
+}
+
+// Scan probes every address in a local network, parallel at a time, and
+// returns the results in address order
+func (d *Driver) Scan(cidr string, parallel int) ([]*AddrState, error) {
+	p, err := d.checkPool(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := p.Mask.Size()
+	if bits-ones > maxScanBits {
+		return nil, fmt.Errorf("Network %v is too large to scan, the limit is a /%v", p.IPNet, bits-maxScanBits)
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	lo, hi := netBounds(p.IPNet)
+	if bits-ones >= 2 { // skip the network and broadcast addresses
+		lo.Add(lo, big.NewInt(1))
+		hi.Sub(hi, big.NewInt(1))
+	}
+	v4 := p.IP.To4() != nil
+	var ips []net.IP
+	for i := lo; i.Cmp(hi) <= 0; i = new(big.Int).Add(i, big.NewInt(1)) {
+		ips = append(ips, intToIP(i, v4))
+	}
+
+	res := make([]*AddrState, len(ips))
+	idx := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				res[i] = d.probeState(&net.IPNet{IP: ips[i], Mask: p.Mask}, p.cfg)
+			}
+		}()
+	}
+	for i := range ips {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	return res, nil
+}
+
+// Suggest returns up to n unused addresses from a local network, chosen the
+// same way as random addresses for docker
+func (d *Driver) Suggest(cidr string, n int) ([]net.IP, error) {
+	p, err := d.checkPool(cidr)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newAddrWalker(p)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for len(ips) < n {
+		addr, err := d.nextUnusedAddr(context.Background(), p, w, p.cfg.probeTimeout)
+		if err != nil {
+			if len(ips) > 0 {
+				return ips, nil
+			}
+			return nil, err
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// checkPool returns a pool for a network outside of docker
+func (d *Driver) checkPool(cidr string) (*pool, error) {
+	p, err := newPool(cidr, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyLocalNet(p.IPNet); err != nil {
+		return nil, err
+	}
+	if p.cfg, err = d.newPoolConfig(p, nil); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
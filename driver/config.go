@@ -0,0 +1,156 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"gopkg.in/yaml.v2"
+)
+
+// fileConfig is the configuration file. Defaults and pool options take the
+// same options as docker network create --ipam-opt, and are applied over the
+// command line flags.
+//
+//	log-level: info
+//	reserve:
+//	  - 10.0.0.1
+//	  - 10.0.0.10-10.0.0.20
+//	defaults:
+//	  arp-ipam.probe: arp
+//	  arp-ipam.probe-timeout: 5s
+//	pools:
+//	  10.0.0.0/24:
+//	    arp-ipam.exclude-first: 10
+type fileConfig struct {
+	LogLevel string                       `yaml:"log-level"`
+	Reserve  []string                     `yaml:"reserve"`
+	Defaults map[string]string            `yaml:"defaults"`
+	Pools    map[string]map[string]string `yaml:"pools"`
+}
+
+// parsedConfig is a configuration file checked and ready to apply
+type parsedConfig struct {
+	logLevel log.Level
+	setLevel bool
+	defaults poolConfig
+	reserved ipRanges
+	poolOpts map[string]map[string]string
+}
+
+// Reload reads the configuration file again and applies it to the driver and
+// every pool in use. The previous configuration is kept if the file is invalid.
+// Requests in flight finish with the configuration they started with.
+func (d *Driver) Reload() error {
+	if d.configFile == "" {
+		log.Info("No configuration file to reload")
+		return nil
+	}
+	pc, err := d.readConfig(d.configFile)
+	if err != nil {
+		return err
+	}
+	d.applyConfig(pc)
+	d.refreshPools()
+	log.WithField("file", d.configFile).Info("Reloaded configuration")
+	return nil
+}
+
+// readConfig reads and checks the configuration file at path
+func (d *Driver) readConfig(path string) (*parsedConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.WithError(err).WithField("file", path).Error("Error reading configuration")
+		return nil, err
+	}
+	var fc fileConfig
+	if err := yaml.Unmarshal(b, &fc); err != nil {
+		log.WithError(err).WithField("file", path).Error("Error parsing configuration")
+		return nil, err
+	}
+
+	pc := &parsedConfig{
+		defaults: d.flagDefaults,
+		reserved: append(ipRanges(nil), d.flagReserved...),
+		poolOpts: make(map[string]map[string]string),
+	}
+	if fc.LogLevel != "" {
+		if pc.logLevel, err = log.ParseLevel(fc.LogLevel); err != nil {
+			return nil, err
+		}
+		pc.setLevel = true
+	}
+	for _, s := range fc.Reserve {
+		r, err := parseRanges(s)
+		if err != nil {
+			log.WithError(err).WithField("reservation", s).Error("Error parsing reservation")
+			return nil, err
+		}
+		pc.reserved = append(pc.reserved, r...)
+	}
+	if err := pc.defaults.apply(fc.Defaults); err != nil {
+		return nil, err
+	}
+	if err := pc.defaults.validate(); err != nil {
+		return nil, err
+	}
+	if pc.defaults.prober, err = d.newProber(pc.defaults.probe); err != nil {
+		return nil, err
+	}
+	for pool, opts := range fc.Pools {
+		n, err := netlink.ParseIPNet(pool)
+		if err != nil {
+			log.WithError(err).WithField("pool", pool).Error("Error parsing pool in configuration")
+			return nil, err
+		}
+		c := pc.defaults
+		if err := c.apply(opts); err != nil {
+			return nil, fmt.Errorf("Pool %v: %v", pool, err)
+		}
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("Pool %v: %v", pool, err)
+		}
+		if _, err := d.newProber(c.probe); err != nil {
+			return nil, fmt.Errorf("Pool %v: %v", pool, err)
+		}
+		n.IP = n.IP.Mask(n.Mask)
+		pc.poolOpts[n.String()] = opts
+	}
+	return pc, nil
+}
+
+// applyConfig makes pc the driver configuration. Pools already in use are not
+// changed until they are refreshed.
+func (d *Driver) applyConfig(pc *parsedConfig) {
+	if pc.setLevel {
+		log.SetLevel(pc.logLevel)
+	}
+	d.cfgLock.Lock()
+	defer d.cfgLock.Unlock()
+	d.defaults = pc.defaults
+	d.reserved = pc.reserved
+	d.poolOpts = pc.poolOpts
+}
+
+// refreshPools rebuilds the configuration of every pool in use and hands it to
+// the pool's candidate list
+func (d *Driver) refreshPools() {
+	opts := d.ledger.poolOptions()
+	d.poolLock.Lock()
+	defer d.poolLock.Unlock()
+	for id := range d.pools {
+		p, err := parsePoolID(id)
+		if err != nil {
+			continue
+		}
+		if p.cfg, err = d.newPoolConfig(p, opts[id]); err != nil {
+			log.WithError(err).WithField("pool", id).Error("Error refreshing pool configuration, keeping the previous configuration")
+			continue
+		}
+		d.pools[id] = p.cfg
+		if cl := d.candidates.get(id); cl != nil {
+			cl.setPool(p)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// conflictRepeat is how often a conflict with the same MAC is reported again
+const conflictRepeat = 1 * time.Minute
+
+const webhookTimeout = 10 * time.Second
+
+// Conflict is sent to the conflict webhook when an allocated address is seen
+// at a MAC other than its endpoint's
+type Conflict struct {
+	Pool     string    `json:"pool"`
+	Address  string    `json:"address"`
+	Expected string    `json:"expected"`
+	Seen     string    `json:"seen"`
+	Time     time.Time `json:"time"`
+}
+
+// conflictMonitors watches allocated addresses for conflicts
+type conflictMonitors struct {
+	lock     sync.Mutex
+	monitors map[string]chan struct{} // map of pool and IP to a channel stopping its monitor
+	webhook  string
+}
+
+// watchAddress starts monitoring addr, replacing any existing monitor. If mac is nil
+// the first MAC seen at addr is assumed to be the endpoint's.
+func (d *Driver) watchAddress(pool string, addr *net.IPNet, mac net.HardwareAddr) {
+	stop := make(chan struct{})
+	cm := d.conflicts
+	k := addrKey(pool, addr.IP)
+	cm.lock.Lock()
+	if s, ok := cm.monitors[k]; ok {
+		close(s)
+	}
+	cm.monitors[k] = stop
+	cm.lock.Unlock()
+	go d.monitor(pool, addr, mac, stop)
+}
+
+// unwatchAddress stops monitoring ip in pool
+func (d *Driver) unwatchAddress(pool string, ip net.IP) {
+	k := addrKey(pool, ip)
+	cm := d.conflicts
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if s, ok := cm.monitors[k]; ok {
+		close(s)
+		delete(cm.monitors, k)
+	}
+}
+
+func (d *Driver) monitor(pool string, addr *net.IPNet, mac net.HardwareAddr, stop <-chan struct{}) {
+	sub, err := d.ns.addSub(addr)
+	if err != nil {
+		return
+	}
+	defer sub.delSub()
+
+	// Watch arp directly as well, the neighbor table is only updated when the
+	// host itself talks to the address
+	var arp <-chan *arpPacket
+	var arpDead <-chan struct{}
+	stopARP := func() {}
+	watchARP := func() {
+		l, _, err := d.arpListeners.get(addr.IP)
+		if err != nil {
+			log.WithError(err).WithField("ip", addr.IP).Warn("Not watching arp for conflicts")
+			arp, arpDead = nil, nil
+			return
+		}
+		arp, stopARP = l.watch(addr.IP)
+		arpDead = l.dead
+	}
+	if addr.IP.To4() != nil {
+		watchARP()
+	}
+	defer func() { stopARP() }()
+
+	reported := make(map[string]time.Time)
+	for {
+		var seen net.HardwareAddr
+		select {
+		case n := <-sub.sub:
+			if !resolved(n) {
+				continue
+			}
+			seen = n.HardwareAddr
+		case p := <-arp:
+			if !p.senderIP.Equal(addr.IP) {
+				continue
+			}
+			seen = p.senderMAC
+		case <-arpDead:
+			// The listener stopped, watch on a new one unless shutting down
+			stopARP()
+			select {
+			case <-d.quit:
+				return
+			default:
+			}
+			watchARP()
+			continue
+		case <-stop:
+			return
+		case <-d.quit:
+			return
+		}
+		if mac == nil {
+			mac = seen
+			log.WithField("ip", addr.IP).WithField("mac", mac).Debug("Learned endpoint MAC")
+			continue
+		}
+		if bytes.Equal(seen, mac) {
+			continue
+		}
+		if t, ok := reported[seen.String()]; ok && time.Since(t) < conflictRepeat {
+			continue
+		}
+		reported[seen.String()] = time.Now()
+		d.conflict(&Conflict{
+			Pool:     pool,
+			Address:  addr.IP.String(),
+			Expected: mac.String(),
+			Seen:     seen.String(),
+			Time:     time.Now(),
+		})
+	}
+}
+
+// conflict reports a conflict
+func (d *Driver) conflict(c *Conflict) {
+	log.WithField("ip", c.Address).
+		WithField("pool", c.Pool).
+		WithField("expected", c.Expected).
+		WithField("seen", c.Seen).
+		Error("Address conflict detected")
+	addressConflicts.WithLabelValues(c.Pool).Inc()
+	if d.conflicts.webhook == "" {
+		return
+	}
+	go func() {
+		if err := postConflict(d.conflicts.webhook, c); err != nil {
+			log.WithError(err).WithField("webhook", d.conflicts.webhook).Error("Error sending conflict webhook")
+		}
+	}()
+}
+
+func postConflict(url string, c *Conflict) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected status: %v", resp.Status)
+	}
+	return nil
+}
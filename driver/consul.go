@@ -0,0 +1,259 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	consulTimeout = 5 * time.Second
+	// Leases are deleted this long after the host stops renewing its session
+	consulSessionTTL = 30 * time.Second
+)
+
+var errConsulNotFound = errors.New("Consul key not found")
+
+// consulCoordinator holds leases as keys in the consul KV store, acquired with
+// a session so only one owner holds each key. The session is renewed while the
+// driver runs. If the host dies it expires and consul deletes its keys.
+type consulCoordinator struct {
+	addr   string
+	prefix string
+	client *http.Client
+	quit   <-chan struct{}
+
+	lock    sync.Mutex
+	session string
+	held    map[string]string // map of key to owner, taken again if the session is lost
+}
+
+// consulKV is a key as returned by the consul KV API
+type consulKV struct {
+	Value       []byte
+	Session     string
+	ModifyIndex uint64
+}
+
+func newConsulCoordinator(quit <-chan struct{}, addr, prefix string) *consulCoordinator {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &consulCoordinator{
+		addr:   strings.TrimSuffix(addr, "/"),
+		prefix: strings.Trim(prefix, "/"),
+		client: &http.Client{Timeout: consulTimeout},
+		quit:   quit,
+		held:   make(map[string]string),
+	}
+}
+
+func (c *consulCoordinator) key(pool string, ip net.IP) string {
+	k := &url.URL{Path: pool + "/" + ip.String()}
+	if c.prefix != "" {
+		k.Path = c.prefix + "/" + k.Path
+	}
+	return c.addr + "/v1/kv/" + k.EscapedPath()
+}
+
+func (c *consulCoordinator) Lease(pool string, ip net.IP, owner string) error {
+	k := c.key(pool, ip)
+	for i := 0; i < 2; i++ {
+		ok, err := c.acquire(k, owner)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		kv, err := c.get(k)
+		if err == errConsulNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if string(kv.Value) != owner {
+			return &leasedError{ip: ip, owner: string(kv.Value)}
+		}
+		// This host took the lease in a session from before it restarted, which
+		// would delete the key when it expires. Take it again in this session.
+		if err := c.delete(k, kv.ModifyIndex); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Unable to lease address %v", ip)
+}
+
+func (c *consulCoordinator) Release(pool string, ip net.IP, owner string) error {
+	k := c.key(pool, ip)
+	c.lock.Lock()
+	delete(c.held, k)
+	c.lock.Unlock()
+	kv, err := c.get(k)
+	if err == errConsulNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(kv.Value) != owner {
+		return &leasedError{ip: ip, owner: string(kv.Value)}
+	}
+	return c.delete(k, kv.ModifyIndex)
+}
+
+// acquire takes key k for owner in this host's session, returning false if
+// another owner holds it
+func (c *consulCoordinator) acquire(k, owner string) (bool, error) {
+	c.lock.Lock()
+	o, ok := c.held[k]
+	c.lock.Unlock()
+	// Consul lets a session acquire a key it already holds, whatever the value
+	if ok && o != owner {
+		return false, nil
+	}
+	s, err := c.sessionID(owner)
+	if err != nil {
+		return false, err
+	}
+	b, err := c.do(http.MethodPut, k+"?acquire="+url.QueryEscape(s), []byte(owner))
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(string(b)) != "true" {
+		return false, nil
+	}
+	c.lock.Lock()
+	c.held[k] = owner
+	c.lock.Unlock()
+	return true, nil
+}
+
+func (c *consulCoordinator) get(k string) (*consulKV, error) {
+	b, err := c.do(http.MethodGet, k, nil)
+	if err != nil {
+		return nil, err
+	}
+	var kvs []*consulKV
+	if err := json.Unmarshal(b, &kvs); err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, errConsulNotFound
+	}
+	return kvs[0], nil
+}
+
+// delete deletes key k if it hasn't been modified since index
+func (c *consulCoordinator) delete(k string, index uint64) error {
+	b, err := c.do(http.MethodDelete, k+"?cas="+strconv.FormatUint(index, 10), nil)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(b)) != "true" {
+		return fmt.Errorf("Consul key %v changed while deleting it", k)
+	}
+	return nil
+}
+
+// sessionID returns this host's session, creating it if there isn't one
+func (c *consulCoordinator) sessionID(owner string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.session != "" {
+		return c.session, nil
+	}
+	req, err := json.Marshal(map[string]string{
+		"Name":     "docker-arp-ipam " + owner,
+		"TTL":      consulSessionTTL.String(),
+		"Behavior": "delete",
+	})
+	if err != nil {
+		return "", err
+	}
+	b, err := c.do(http.MethodPut, c.addr+"/v1/session/create", req)
+	if err != nil {
+		return "", err
+	}
+	var s struct{ ID string }
+	if err := json.Unmarshal(b, &s); err != nil {
+		return "", err
+	}
+	if s.ID == "" {
+		return "", errors.New("Consul created a session with no ID")
+	}
+	log.WithField("session", s.ID).Debug("Created consul session")
+	c.session = s.ID
+	go c.renew(s.ID)
+	return s.ID, nil
+}
+
+// renew renews session id until quit is closed. If consul has lost the
+// session, the keys it held are taken again in a new one.
+func (c *consulCoordinator) renew(id string) {
+	t := time.NewTicker(consulSessionTTL / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+		}
+		_, err := c.do(http.MethodPut, c.addr+"/v1/session/renew/"+id, nil)
+		if err == nil {
+			continue
+		}
+		if err != errConsulNotFound {
+			log.WithError(err).WithField("session", id).Warn("Error renewing consul session")
+			continue
+		}
+		log.WithField("session", id).Error("Consul session expired, leasing addresses again")
+		c.lock.Lock()
+		c.session = ""
+		held := c.held
+		c.held = make(map[string]string)
+		c.lock.Unlock()
+		for k, owner := range held {
+			ok, err := c.acquire(k, owner)
+			if err != nil || !ok {
+				log.WithError(err).WithField("key", k).Error("Lost lease on allocated address")
+			}
+		}
+		return
+	}
+}
+
+func (c *consulCoordinator) do(method, u string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errConsulNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Consul %v %v: %v", method, u, resp.Status)
+	}
+	return b, nil
+}
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CoordinatorConsul is the consul coordination backend
+const CoordinatorConsul = "consul"
+
+// Random addresses are retried this many times if another host holds a lease
+const leaseAttempts = 5
+
+// Coordinator shares leases on addresses between hosts, so two hosts never
+// hand out the same address in the global address space
+type Coordinator interface {
+	// Lease takes a lease on ip in pool for owner. It fails if another owner
+	// holds the lease and succeeds if owner already does.
+	Lease(pool string, ip net.IP, owner string) error
+	// Release frees the lease owner holds on ip in pool. It fails if another
+	// owner holds the lease.
+	Release(pool string, ip net.IP, owner string) error
+}
+
+// leasedError is returned when another owner holds a lease
+type leasedError struct {
+	ip    net.IP
+	owner string
+}
+
+func (e *leasedError) Error() string {
+	return fmt.Sprintf("Address %v is leased by %v", e.ip, e.owner)
+}
+
+// CoordinatorOptions configures a coordination backend
+type CoordinatorOptions struct {
+	// Backend is one of the Coordinator constants, empty for no coordination
+	Backend string
+	// Owner identifies this host in leases
+	Owner string
+	// Address is the address of the backend
+	Address string
+	// Prefix is prepended to every key in the backend
+	Prefix string
+}
+
+func newCoordinator(quit <-chan struct{}, opts *CoordinatorOptions) (Coordinator, error) {
+	switch opts.Backend {
+	case "":
+		return nil, nil
+	case CoordinatorConsul:
+		return newConsulCoordinator(quit, opts.Address, opts.Prefix), nil
+	}
+	return nil, fmt.Errorf("Unknown coordinator: %v", opts.Backend)
+}
+
+// coordinated returns true if allocations in p are leased from the coordinator
+func (d *Driver) coordinated(p *pool) bool {
+	return d.coordinator != nil && p.space == d.globalSpace
+}
+
+// lease takes a lease on ip if p is coordinated
+func (d *Driver) lease(p *pool, ip net.IP) error {
+	if !d.coordinated(p) {
+		return nil
+	}
+	if err := d.coordinator.Lease(p.id(), ip, d.owner); err != nil {
+		log.WithError(err).WithField("pool", p.id()).WithField("ip", ip).Debug("Error taking lease")
+		return err
+	}
+	return nil
+}
+
+// release frees the lease on ip if p is coordinated
+func (d *Driver) release(p *pool, ip net.IP) error {
+	if !d.coordinated(p) {
+		return nil
+	}
+	if err := d.coordinator.Release(p.id(), ip, d.owner); err != nil {
+		log.WithError(err).WithField("pool", p.id()).WithField("ip", ip).Error("Error releasing lease")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+)
+
+// fakeConsul implements the parts of the consul session and KV APIs the
+// coordinator uses
+type fakeConsul struct {
+	lock     sync.Mutex
+	index    uint64
+	sessions map[string]bool
+	kv       map[string]*consulKV
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{sessions: make(map[string]bool), kv: make(map[string]*consulKV)}
+}
+
+// expire ends session s, deleting the keys it holds
+func (f *fakeConsul) expire(s string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.sessions, s)
+	for k, kv := range f.kv {
+		if kv.Session == s {
+			delete(f.kv, k)
+		}
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	q := r.URL.Query()
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		f.index++
+		id := fmt.Sprintf("session-%v", f.index)
+		f.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		if !f.sessions[strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		k := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		kv := f.kv[k]
+		switch r.Method {
+		case http.MethodGet:
+			if kv == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode([]*consulKV{kv})
+		case http.MethodPut:
+			s := q.Get("acquire")
+			if !f.sessions[s] || (kv != nil && kv.Session != "" && kv.Session != s) {
+				fmt.Fprint(w, "false")
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			f.index++
+			f.kv[k] = &consulKV{Value: b, Session: s, ModifyIndex: f.index}
+			fmt.Fprint(w, "true")
+		case http.MethodDelete:
+			i, _ := strconv.ParseUint(q.Get("cas"), 10, 64)
+			if kv == nil || kv.ModifyIndex != i {
+				fmt.Fprint(w, "false")
+				return
+			}
+			delete(f.kv, k)
+			fmt.Fprint(w, "true")
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// memCoordinator holds leases in memory. It only coordinates within a single
+// process, for testing the coordinator contract and the driver's use of it.
+type memCoordinator struct {
+	lock   sync.Mutex
+	leases map[string]string // map of pool and IP to owner
+}
+
+func newMemCoordinator() *memCoordinator {
+	return &memCoordinator{leases: make(map[string]string)}
+}
+
+func (c *memCoordinator) Lease(pool string, ip net.IP, owner string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	k := pool + "/" + ip.String()
+	if o, ok := c.leases[k]; ok && o != owner {
+		return &leasedError{ip: ip, owner: o}
+	}
+	c.leases[k] = owner
+	return nil
+}
+
+func (c *memCoordinator) Release(pool string, ip net.IP, owner string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	k := pool + "/" + ip.String()
+	if o, ok := c.leases[k]; ok && o != owner {
+		return &leasedError{ip: ip, owner: o}
+	}
+	delete(c.leases, k)
+	return nil
+}
+
+func testCoordinator(t *testing.T, c Coordinator) {
+	pool := "arp-ipam-global/10.0.0.0/24"
+	ip := net.ParseIP("10.0.0.5")
+	if err := c.Lease(pool, ip, "a"); err != nil {
+		t.Fatalf("Lease of free address: %v", err)
+	}
+	if err := c.Lease(pool, ip, "a"); err != nil {
+		t.Errorf("Lease already held by the same owner: %v", err)
+	}
+	if err := c.Lease(pool, ip, "b"); err == nil {
+		t.Error("Lease held by another owner succeeded")
+	}
+	if err := c.Lease("arp-ipam-global/10.0.0.0/16", ip, "b"); err != nil {
+		t.Errorf("Lease of the address in another pool: %v", err)
+	}
+	if err := c.Release(pool, ip, "b"); err == nil {
+		t.Error("Release of another owner's lease succeeded")
+	}
+	if err := c.Release(pool, ip, "a"); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+	if err := c.Release(pool, ip, "a"); err != nil {
+		t.Errorf("Release of a free address: %v", err)
+	}
+	if err := c.Lease(pool, ip, "b"); err != nil {
+		t.Errorf("Lease of a released address: %v", err)
+	}
+}
+
+func TestMemCoordinator(t *testing.T) {
+	testCoordinator(t, newMemCoordinator())
+}
+
+func TestConsulCoordinator(t *testing.T) {
+	s := httptest.NewServer(newFakeConsul())
+	defer s.Close()
+	quit := make(chan struct{})
+	defer close(quit)
+	testCoordinator(t, newConsulCoordinator(quit, s.URL, "docker-arp-ipam"))
+}
+
+func TestConsulCoordinatorSessions(t *testing.T) {
+	f := newFakeConsul()
+	s := httptest.NewServer(f)
+	defer s.Close()
+	quit := make(chan struct{})
+	defer close(quit)
+	pool := "arp-ipam-global/10.0.0.0/24"
+	ip := net.ParseIP("10.0.0.5")
+
+	a := newConsulCoordinator(quit, s.URL, "")
+	if err := a.Lease(pool, ip, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// After a restart the same host takes its lease into its new session
+	restarted := newConsulCoordinator(quit, s.URL, "")
+	if err := restarted.Lease(pool, ip, "a"); err != nil {
+		t.Fatalf("Lease held in an earlier session of the same owner: %v", err)
+	}
+	if err := newConsulCoordinator(quit, s.URL, "").Lease(pool, ip, "b"); err == nil {
+		t.Error("Lease held by another owner succeeded")
+	}
+	// Leases of a host that stops renewing expire
+	f.expire(restarted.session)
+	if err := newConsulCoordinator(quit, s.URL, "").Lease(pool, ip, "b"); err != nil {
+		t.Errorf("Lease of an expired session's address: %v", err)
+	}
+}
+
+func TestCoordinatedSpaces(t *testing.T) {
+	d := &Driver{coordinator: newMemCoordinator()}
+	if err := d.loadSpaces(""); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{
+		"10.0.0.0/24":                 false,
+		"arp-ipam-global/10.0.0.0/24": true,
+	} {
+		p, err := parsePoolID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.coordinated(p) != want {
+			t.Errorf("Pool %v coordinated: %v, want %v", id, !want, want)
+		}
+	}
+}
+
+// downCoordinator fails every request, as when the backend is unreachable
+type downCoordinator struct{}
+
+func (downCoordinator) Lease(pool string, ip net.IP, owner string) error {
+	return fmt.Errorf("coordinator down")
+}
+
+func (downCoordinator) Release(pool string, ip net.IP, owner string) error {
+	return fmt.Errorf("coordinator down")
+}
+
+func TestReleaseAddressCoordinated(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	d, p, _ := testCandidates(t, quit, "arp-ipam-global/10.0.0.0/24", testConfig())
+	if err := d.loadSpaces(""); err != nil {
+		t.Fatal(err)
+	}
+	d.pools = map[string]*poolConfig{p.id(): p.cfg}
+	d.conflicts = &conflictMonitors{monitors: make(map[string]chan struct{})}
+	d.owner = "a"
+	ip := net.ParseIP("10.0.0.5")
+	r := &ipam.ReleaseAddressRequest{PoolID: p.id(), Address: ip.String()}
+	if err := d.ledger.add(p.id(), ip, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The allocation is kept so a failed release can be retried
+	d.coordinator = downCoordinator{}
+	if err := d.ReleaseAddress(r); err == nil {
+		t.Error("Release with the coordinator down succeeded")
+	}
+	if d.ledger.get(p.id(), ip) == nil {
+		t.Error("Allocation dropped when its lease wasn't released")
+	}
+
+	// A lease another owner holds isn't this host's to release
+	c := newMemCoordinator()
+	if err := c.Lease(p.id(), ip, "b"); err != nil {
+		t.Fatal(err)
+	}
+	d.coordinator = c
+	if err := d.ReleaseAddress(r); err != nil {
+		t.Errorf("Release of an address leased by another owner: %v", err)
+	}
+	if d.ledger.get(p.id(), ip) != nil {
+		t.Error("Allocation kept after release")
+	}
+}
@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var errShuttingDown = errors.New("driver is shutting down")
+
+// begin tracks a request which changes allocations, failing once the driver is
+// draining. The returned func must be called when the request is finished.
+func (d *Driver) begin() (func(), error) {
+	d.drainLock.Lock()
+	defer d.drainLock.Unlock()
+	if d.draining {
+		return nil, errShuttingDown
+	}
+	d.inflight.Add(1)
+	return d.inflight.Done, nil
+}
+
+// Drain stops the driver accepting requests and waits up to timeout for those
+// in flight to finish. It returns false if some were still running, they fail
+// once quit is closed.
+func (d *Driver) Drain(timeout time.Duration) bool {
+	d.drainLock.Lock()
+	d.draining = true
+	d.drainLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Debug("Drained in-flight requests")
+		return true
+	case <-time.After(timeout):
+		log.WithField("timeout", timeout).Warn("Timed out draining in-flight requests")
+		return false
+	}
+}
@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"net/http"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/sdk"
+)
+
+const ipamManifest = `{"Implements": ["IpamDriver"]}`
+
+// Handler returns the plugin's http handler. It serves the same endpoints as
+// ipam.NewHandler, but passes the http request's context to RequestAddress so
+// probing stops when docker disconnects.
+func (d *Driver) Handler() sdk.Handler {
+	h := sdk.NewHandler(ipamManifest)
+	h.HandleFunc("/IpamDriver.GetCapabilities", func(w http.ResponseWriter, r *http.Request) {
+		res, err := d.GetCapabilities()
+		encodeResponse(w, res, err)
+	})
+	h.HandleFunc("/IpamDriver.GetDefaultAddressSpaces", func(w http.ResponseWriter, r *http.Request) {
+		res, err := d.GetDefaultAddressSpaces()
+		encodeResponse(w, res, err)
+	})
+	h.HandleFunc("/IpamDriver.RequestPool", func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.RequestPoolRequest{}
+		if err := sdk.DecodeRequest(w, r, req); err != nil {
+			return
+		}
+		res, err := d.RequestPool(req)
+		encodeResponse(w, res, err)
+	})
+	h.HandleFunc("/IpamDriver.ReleasePool", func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.ReleasePoolRequest{}
+		if err := sdk.DecodeRequest(w, r, req); err != nil {
+			return
+		}
+		encodeResponse(w, struct{}{}, d.ReleasePool(req))
+	})
+	h.HandleFunc("/IpamDriver.RequestAddress", func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.RequestAddressRequest{}
+		if err := sdk.DecodeRequest(w, r, req); err != nil {
+			return
+		}
+		res, err := d.requestAddressContext(r.Context(), req)
+		encodeResponse(w, res, err)
+	})
+	h.HandleFunc("/IpamDriver.ReleaseAddress", func(w http.ResponseWriter, r *http.Request) {
+		req := &ipam.ReleaseAddressRequest{}
+		if err := sdk.DecodeRequest(w, r, req); err != nil {
+			return
+		}
+		encodeResponse(w, struct{}{}, d.ReleaseAddress(req))
+	})
+	return h
+}
+
+func encodeResponse(w http.ResponseWriter, res interface{}, err error) {
+	if err != nil {
+		sdk.EncodeResponse(w, ipam.NewErrorResponse(err.Error()), true)
+		return
+	}
+	sdk.EncodeResponse(w, res, false)
+}
@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	icmpEchoRequest   = 8
+	icmpEchoReply     = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// icmpProber sends icmp echo requests and waits for a reply
+type icmpProber struct{}
+
+func icmpChecksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+func (p *icmpProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	v4 := addr.IP.To4() != nil
+	var fd int
+	var err error
+	var sa syscall.Sockaddr
+	if v4 {
+		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], addr.IP.To4())
+		sa = sa4
+	} else {
+		fd, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+
+	id := uint16(os.Getpid())
+	seq := uint16(rand.Intn(1 << 16))
+	msg := make([]byte, 16)
+	if v4 {
+		msg[0] = icmpEchoRequest
+	} else {
+		msg[0] = icmpv6EchoRequest
+	}
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	copy(msg[8:], "arp-ipam")
+
+	buf := make([]byte, 1500)
+	stop := time.Now().Add(to)
+	var nextSend time.Time
+	for time.Now().Before(stop) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		if !time.Now().Before(nextSend) {
+			seq++
+			binary.BigEndian.PutUint16(msg[6:8], seq)
+			// The kernel calculates the checksum for icmpv6
+			if v4 {
+				binary.BigEndian.PutUint16(msg[2:4], 0)
+				binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+			}
+			if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+				return false, err
+			}
+			nextSend = time.Now().Add(probeInterval)
+		}
+		n, from, err := recvDeadline(fd, buf, nextWait(nextSend, stop))
+		if err == errRecvTimeout {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		r := buf[:n]
+		var src net.IP
+		if v4 {
+			// raw ipv4 sockets include the ip header
+			if len(r) < 20 {
+				continue
+			}
+			ihl := int(r[0]&0x0f) * 4
+			if ihl < 20 || len(r) < ihl+8 {
+				continue
+			}
+			src = net.IP(r[12:16])
+			r = r[ihl:]
+		} else if f, ok := from.(*syscall.SockaddrInet6); ok {
+			src = net.IP(f.Addr[:])
+		}
+		if len(r) < 8 || !src.Equal(addr.IP) || binary.BigEndian.Uint16(r[4:6]) != id {
+			continue
+		}
+		if (v4 && r[0] == icmpEchoReply) || (!v4 && r[0] == icmpv6EchoReply) {
+			log.WithField("ip", addr.IP).Debug("Echo reply received")
+			return true, nil
+		}
+	}
+	return false, nil
+}
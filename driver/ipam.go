@@ -1,9 +1,13 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"path/filepath"
 	//"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -14,31 +18,195 @@ import (
 
 const candidateSize = 3
 
+// gatewayOption is the key docker uses for a network's gateway
+const gatewayOption = "com.docker.network.gateway"
+
 // Driver is the main driver object for the plugin
 type Driver struct {
 	ipam.Ipam
-	ns         *neighSubscription
-	candidates *candidateNets
-	xf         int
-	xl         int
-	quit       <-chan struct{}
+	ns           *neighSubscription
+	candidates   *candidateNets
+	ledger       *ledger
+	arpListeners *arpListeners
+	conflicts    *conflictMonitors
+	leases       *localLeases
+	cfgLock      sync.RWMutex // protects defaults, reserved and poolOpts
+	defaults     poolConfig
+	flagDefaults poolConfig // defaults before the configuration file is applied
+	poolProbes   map[string]string
+	poolOpts     map[string]map[string]string // map of network to options from the configuration file
+	configFile   string
+	pools        map[string]*poolConfig // map of pool ID to config
+	poolLock     sync.Mutex
+	reserved     ipRanges
+	flagReserved ipRanges                     // reservations before the configuration file is applied
+	spaces       map[string]map[string]string // map of address space to its pool options
+	localSpace   string
+	globalSpace  string
+	coordinator  Coordinator
+	owner        string
+	autoAllow    []string
+	autoDeny     []string
+	drainLock    sync.Mutex // protects draining
+	draining     bool
+	inflight     sync.WaitGroup // requests changing allocations
+	quit         <-chan struct{}
+}
+
+// Options configures the driver
+type Options struct {
+	// ExcludeFirst and ExcludeLast are the number of addresses at the start and end
+	// of each pool to never provide as random addresses
+	ExcludeFirst int
+	ExcludeLast  int
+	// StateDir is where allocations are persisted, empty to only keep them in memory
+	StateDir string
+	// ReadOnly reads allocations from StateDir without creating or writing it,
+	// for probing outside of docker
+	ReadOnly bool
+	// Probe is the default probe method
+	Probe string
+	// ProbeTimeout is the default timeout probing an address, zero for the default
+	ProbeTimeout time.Duration
+	// PoolProbes maps a pool to a probe method overriding the default
+	PoolProbes map[string]string
+	// AutoPoolInterfaces limits automatic pool assignment to interfaces matching
+	// these patterns. Empty allows all interfaces.
+	AutoPoolInterfaces []string
+	// AutoPoolExcludeInterfaces prevents automatic pool assignment from interfaces
+	// matching these patterns
+	AutoPoolExcludeInterfaces []string
+	// Reservations are addresses or ranges never provided unless a pool forces
+	// them and they are requested specifically
+	Reservations []string
+	// ReservationsFile is a file of reservations, one per line
+	ReservationsFile string
+	// SweepInterval is the default time between background sweeps of a pool,
+	// zero to never sweep
+	SweepInterval time.Duration
+	// SweepRate is the default number of addresses probed per second while sweeping
+	SweepRate int
+	// Quarantine is how long a released address is kept from being given out randomly
+	Quarantine time.Duration
+	// Announce sends gratuitous arp or unsolicited neighbor advertisements for
+	// allocated addresses once their endpoint appears
+	Announce bool
+	// ConflictWebhook is a URL conflicts on allocated addresses are posted to
+	ConflictWebhook string
+	// AddressSpacesFile is a YAML file of named address spaces and their pool options
+	AddressSpacesFile string
+	// Coordination configures leasing addresses in the global address space
+	// from a backend shared between hosts
+	Coordination CoordinatorOptions
+	// ConfigFile is a YAML file applied over these options, and reloaded by Reload
+	ConfigFile string
 }
 
 // NewDriver returns a driver object
-func NewDriver(quit <-chan struct{}, xf, xl int) *Driver {
+func NewDriver(quit <-chan struct{}, opts *Options) (*Driver, error) {
 	log.Debugf("NewDriver")
+	l, err := newLedger(opts.StateDir, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
 	ns := newNeighSubscription(quit)
 	d := &Driver{
-		ns:   ns,
-		quit: quit,
-		xf:   xf,
-		xl:   xl,
+		ns:           ns,
+		ledger:       l,
+		arpListeners: newARPListeners(quit),
+		poolProbes:   make(map[string]string),
+		pools:        make(map[string]*poolConfig),
+		configFile:   opts.ConfigFile,
+		quit:         quit,
+		autoAllow:    opts.AutoPoolInterfaces,
+		autoDeny:     opts.AutoPoolExcludeInterfaces,
 		candidates: &candidateNets{
 			nets: make(map[string]*candidateList),
 			quit: quit,
 		},
+		leases: newLocalLeases(),
+		conflicts: &conflictMonitors{
+			monitors: make(map[string]chan struct{}),
+			webhook:  opts.ConflictWebhook,
+		},
+	}
+	d.defaults = poolConfig{
+		excludeFirst:     opts.ExcludeFirst,
+		excludeLast:      opts.ExcludeLast,
+		probe:            opts.Probe,
+		probeTimeout:     defaultProbeTimeout,
+		candidateTimeout: defaultCandidateTimeout,
+		requestTimeout:   defaultRequestTimeout,
+		candidates:       candidateSize,
+		sweepInterval:    opts.SweepInterval,
+		sweepRate:        opts.SweepRate,
+		quarantine:       opts.Quarantine,
+		announce:         opts.Announce,
+	}
+	if opts.ProbeTimeout > 0 {
+		d.defaults.probeTimeout = opts.ProbeTimeout
+	}
+	if err := d.defaults.validate(); err != nil {
+		return nil, err
+	}
+	if d.defaults.prober, err = d.newProber(opts.Probe); err != nil {
+		return nil, err
+	}
+	for _, s := range opts.Reservations {
+		r, err := parseRanges(s)
+		if err != nil {
+			log.WithError(err).WithField("reservation", s).Error("Error parsing reservation")
+			return nil, err
+		}
+		d.reserved = append(d.reserved, r...)
+	}
+	if opts.ReservationsFile != "" {
+		r, err := readRangesFile(opts.ReservationsFile)
+		if err != nil {
+			return nil, err
+		}
+		d.reserved = append(d.reserved, r...)
 	}
-	return d
+	for pool, method := range opts.PoolProbes {
+		n, err := netlink.ParseIPNet(pool)
+		if err != nil {
+			log.WithError(err).WithField("pool", pool).Error("Error parsing pool for probe method")
+			return nil, err
+		}
+		if _, err := d.newProber(method); err != nil {
+			return nil, err
+		}
+		n.IP = n.IP.Mask(n.Mask)
+		d.poolProbes[n.String()] = method
+	}
+	d.flagDefaults = d.defaults
+	d.flagReserved = d.reserved
+	if d.configFile != "" {
+		pc, err := d.readConfig(d.configFile)
+		if err != nil {
+			return nil, err
+		}
+		d.applyConfig(pc)
+	}
+	if err := d.loadSpaces(opts.AddressSpacesFile); err != nil {
+		return nil, err
+	}
+	if d.coordinator, err = newCoordinator(quit, &opts.Coordination); err != nil {
+		return nil, err
+	}
+	d.owner = opts.Coordination.Owner
+	for id, o := range l.poolOptions() {
+		p, err := parsePoolID(id)
+		if err != nil {
+			log.WithError(err).WithField("pool", id).Error("Ignoring invalid pool in ledger")
+			continue
+		}
+		if d.pools[id], err = d.newPoolConfig(p, o); err != nil {
+			log.WithError(err).WithField("pool", id).Error("Ignoring invalid pool options in ledger")
+			delete(d.pools, id)
+		}
+	}
+	return d, nil
 }
 
 func (d *Driver) Start() error {
@@ -70,6 +238,57 @@ func (d *Driver) Start() error {
 			}
 		}()
 	*/
+	allocs := d.ledger.list()
+	for _, a := range allocs {
+		p, err := d.getPool(a.Pool)
+		if err != nil {
+			continue
+		}
+		addr := &net.IPNet{IP: net.ParseIP(a.Address), Mask: p.Mask}
+		d.watchAddress(a.Pool, addr, requestMAC(a.Options))
+	}
+	if d.coordinator != nil {
+		go d.leaseAllocations(allocs)
+	}
+	err := d.ns.start()
+	// Requests still in flight fail once quit is closed, let them finish with the ledger
+	d.inflight.Wait()
+	return err
+}
+
+// leaseAllocations takes the coordinator leases of allocations, which expire
+// while the driver isn't running. It runs in the background so a slow
+// coordinator doesn't hold up startup.
+func (d *Driver) leaseAllocations(allocs []*allocation) {
+	for _, a := range allocs {
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+		p, err := d.getPool(a.Pool)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(a.Address)
+		if d.ledger.get(a.Pool, ip) == nil {
+			continue
+		}
+		if err := d.lease(p, ip); err != nil {
+			log.WithError(err).WithField("ip", ip).Error("Unable to lease allocated address")
+			continue
+		}
+		// Don't keep a lease on an address released while it was taken
+		if d.ledger.get(a.Pool, ip) == nil {
+			d.release(p, ip)
+		}
+	}
+}
+
+// StartProbing starts only what probing needs, for checking addresses outside
+// of docker. Allocations aren't watched for conflicts. It returns once quit is
+// closed.
+func (d *Driver) StartProbing() error {
 	return d.ns.start()
 }
 
@@ -77,7 +296,7 @@ func (d *Driver) Start() error {
 func (d *Driver) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
 	log.Debugf("GetCapabilities")
 	return &ipam.CapabilitiesResponse{
-		RequiresMACAddress: false,
+		RequiresMACAddress: true,
 	}, nil
 }
 
@@ -85,40 +304,82 @@ func (d *Driver) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
 func (d *Driver) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
 	log.Debugf("GetDefaultAddressSpaces")
 	return &ipam.AddressSpacesResponse{
-		LocalDefaultAddressSpace:  "arp-ipam-default",
-		GlobalDefaultAddressSpace: "arp-ipam-default",
+		LocalDefaultAddressSpace:  d.localSpace,
+		GlobalDefaultAddressSpace: d.globalSpace,
 	}, nil
 }
 
 // RequestPool requests a pool from the driver
 func (d *Driver) RequestPool(r *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
 	log.Debugf("RequestPool: %v", r)
-	if r.Pool == "" {
-		log.Errorf("Automatic pool assignment not supported")
-		return nil, fmt.Errorf("Automatic pool assignment not supported")
+	done, err := d.begin()
+	if err != nil {
+		return nil, err
 	}
-	if r.V6 {
-		log.Errorf("Automatic V6 pool assignment not supported.")
-		return nil, fmt.Errorf("automatic V6 pool assignment not supported")
+	defer done()
+	var gw net.IP
+	if r.Pool == "" {
+		n, g, err := d.autoPool(r.V6)
+		if err != nil {
+			log.WithError(err).Error("Error assigning pool automatically")
+			return nil, err
+		}
+		log.WithField("pool", n).WithField("gateway", g).Debug("Automatically assigned pool")
+		r.Pool = n.String()
+		gw = g
 	}
-	if r.SubPool != "" {
-		log.Errorf("SubPool not supported.")
-		return nil, fmt.Errorf("subPool not supported")
+	space, err := d.addressSpace(r.AddressSpace)
+	if err != nil {
+		log.WithError(err).Error("Error requesting pool")
+		return nil, err
 	}
-	n, err := netlink.ParseIPNet(r.Pool)
+	p, err := newPool(r.Pool, r.SubPool)
 	if err != nil {
 		log.Errorf("Error parsing pool: %v", err)
 		return nil, err
 	}
+	p.space = space
+	n := p.IPNet
+	if r.V6 != (n.IP.To4() == nil) {
+		log.Errorf("Pool %v does not match requested address family", n)
+		return nil, fmt.Errorf("pool %v does not match requested address family", n)
+	}
 
 	if err := verifyLocalNet(n); err != nil {
 		return nil, err
 	}
 
-	return &ipam.RequestPoolResponse{
-		PoolID: r.Pool,
+	opts := make(map[string]string)
+	for k, v := range r.Options {
+		if strings.HasPrefix(k, optPrefix) {
+			opts[k] = v
+		}
+	}
+	cfg, err := d.newPoolConfig(p, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.poolLock.Lock()
+	d.pools[p.id()] = cfg
+	d.poolLock.Unlock()
+	if len(opts) > 0 {
+		if err := d.ledger.addPool(p.id(), opts); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &ipam.RequestPoolResponse{
+		PoolID: p.id(),
 		Pool:   r.Pool,
-	}, nil
+	}
+	// Docker doesn't take a gateway without a subnet, so an automatically
+	// assigned pool provides the router on the link
+	if gw != nil {
+		res.Data = map[string]string{
+			gatewayOption: (&net.IPNet{IP: gw, Mask: n.Mask}).String(),
+		}
+	}
+	return res, nil
 }
 
 func verifyLocalNet(n *net.IPNet) error {
@@ -141,88 +402,266 @@ func verifyLocalNet(n *net.IPNet) error {
 	return nil
 }
 
+// autoPool returns the first suitable subnet configured on a local interface,
+// and its gateway if the link has a route through one
+func (d *Driver) autoPool(v6 bool) (*net.IPNet, net.IP, error) {
+	family := netlink.FAMILY_V4
+	if v6 {
+		family = netlink.FAMILY_V6
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("Error getting local links: %v", err)
+		return nil, nil, err
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Flags&net.FlagLoopback != 0 || attrs.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if !matchInterface(attrs.Name, d.autoAllow, true) || matchInterface(attrs.Name, d.autoDeny, false) {
+			log.WithField("link", attrs.Name).Debug("Interface excluded from automatic pool assignment")
+			continue
+		}
+		addrs, err := netlink.AddrList(link, family)
+		if err != nil {
+			log.Errorf("Error getting addresses for %v: %v", attrs.Name, err)
+			return nil, nil, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsLoopback() || addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			// Skip networks with no room for another host
+			ones, bits := addr.Mask.Size()
+			if bits-ones < 2 {
+				continue
+			}
+			n := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+			routes, err := netlink.RouteList(link, family)
+			if err != nil {
+				log.Errorf("Error getting routes for %v: %v", attrs.Name, err)
+				return nil, nil, err
+			}
+			gw := routeGateway(routes, n)
+			if gw == nil {
+				log.WithField("pool", n).WithField("link", attrs.Name).Warn("No gateway found for automatically assigned pool")
+			}
+			return n, gw, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("No suitable local network for automatic pool assignment")
+}
+
+// routeGateway returns the gateway in n from routes, preferring the default route
+func routeGateway(routes []netlink.Route, n *net.IPNet) net.IP {
+	var gw net.IP
+	for _, r := range routes {
+		if r.Gw == nil || !n.Contains(r.Gw) {
+			continue
+		}
+		if r.Dst == nil || isDefaultRoute(r.Dst) {
+			return r.Gw
+		}
+		if gw == nil {
+			gw = r.Gw
+		}
+	}
+	return gw
+}
+
+func isDefaultRoute(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// matchInterface returns true if name matches any of patterns, or def if there are no patterns
+func matchInterface(name string, patterns []string, def bool) bool {
+	if len(patterns) == 0 {
+		return def
+	}
+	for _, p := range patterns {
+		if m, err := filepath.Match(p, name); err == nil && m {
+			return true
+		}
+	}
+	return false
+}
+
+// localLink returns the link and local address in the same network as ip
+func localLink(ip net.IP) (netlink.Link, *net.IPNet, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("Error getting local links: %v", err)
+		return nil, nil, err
+	}
+	for _, link := range links {
+		addrs, err := netlink.AddrList(link, ipFamily(ip))
+		if err != nil {
+			log.Errorf("Error getting addresses for %v: %v", link.Attrs().Name, err)
+			return nil, nil, err
+		}
+		for _, addr := range addrs {
+			if addr.Contains(ip) {
+				return link, addr.IPNet, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("No local link for %v", ip)
+}
+
 // ReleasePool releases a pool
 func (d *Driver) ReleasePool(r *ipam.ReleasePoolRequest) error {
 	log.Debugf("ReleasePool: %v", r)
-	return nil
+	done, err := d.begin()
+	if err != nil {
+		return err
+	}
+	defer done()
+	d.poolLock.Lock()
+	delete(d.pools, r.PoolID)
+	d.poolLock.Unlock()
+	d.candidates.remove(r.PoolID)
+	deletePoolMetrics(r.PoolID)
+	return d.ledger.delPool(r.PoolID)
 }
 
 // RequestAddress requests an address
 func (d *Driver) RequestAddress(r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	return d.requestAddressContext(context.Background(), r)
+}
+
+// requestAddressContext serves RequestAddress, giving up on probing when
+// parent is cancelled, e.g. because docker disconnected
+func (d *Driver) requestAddressContext(parent context.Context, r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
 	st := time.Now()
-	t := time.NewTimer(10 * time.Second)
-	retCh := make(chan *ipam.RequestAddressResponse)
-	errCh := make(chan error)
-	go func() {
-		ret, err := d.requestAddress(r)
-		retCh <- ret
-		errCh <- err
-	}()
-	select {
-	case ret := <-retCh:
-		err := <-errCh
-		if err != nil {
-			log.WithError(err).WithField("Time", time.Now().Sub(st).String()).Error("Error serving RequestAddress")
-		}
-		if ret != nil {
-			log.WithField("Address", ret.Address).WithField("Time", time.Now().Sub(st).String()).Debug("RequestAddress served")
-		}
-		return ret, err
-	case <-t.C:
+	done, err := d.begin()
+	if err != nil {
+		log.WithError(err).Error("Error serving RequestAddress")
+		return nil, err
+	}
+	to := d.defaultConfig().requestTimeout
+	if p, err := d.getPool(r.PoolID); err == nil {
+		to = p.cfg.requestTimeout
+	}
+	defer done()
+	// Probing gives up once the timeout passes or the client goes away, so
+	// the request returns promptly without leaving anything running.
+	ctx, cancel := context.WithTimeout(parent, to)
+	defer cancel()
+	ret, err := d.requestAddress(ctx, r)
+	if err != nil && parent.Err() != nil {
+		log.Error("RequestAddress cancelled.")
+		requestDuration.WithLabelValues("cancelled").Observe(time.Since(st).Seconds())
+		return nil, fmt.Errorf("request address cancelled")
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
 		log.Error("RequestAddress timed out.")
+		requestDuration.WithLabelValues("timeout").Observe(time.Since(st).Seconds())
 		return nil, fmt.Errorf("request address timed out")
 	}
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+		log.WithError(err).WithField("Time", time.Now().Sub(st).String()).Error("Error serving RequestAddress")
+	}
+	if ret != nil {
+		log.WithField("Address", ret.Address).WithField("Time", time.Now().Sub(st).String()).Debug("RequestAddress served")
+	}
+	requestDuration.WithLabelValues(outcome).Observe(time.Since(st).Seconds())
+	return ret, err
 }
 
 // RequestAddress requests an address
-func (d *Driver) requestAddress(r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
-	//todo add a timeout
+func (d *Driver) requestAddress(ctx context.Context, r *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
 	log.Debugf("RequestAddress: %v", r)
 
-	n, err := netlink.ParseIPNet(r.PoolID)
+	p, err := d.getPool(r.PoolID)
 	if err != nil {
 		log.Errorf("Unable to parse PoolID: %v", r.PoolID)
 		log.Errorf("err: %v", err)
 		return nil, err
 	}
+	n := p.IPNet
 
 	if err = verifyLocalNet(n); err != nil {
 		return nil, err
 	}
 
 	res := &ipam.RequestAddressResponse{}
+	mac := requestMAC(r.Options)
 
 	if r.Address != "" {
 		log.Debugf("Specific Address Requested: %v", r.Address)
 
 		addr := &net.IPNet{IP: net.ParseIP(r.Address), Mask: n.Mask}
-		if addr == nil {
+		if addr.IP == nil {
 			log.Errorf("Unable to parse address: %v", r.Address)
 			return nil, fmt.Errorf("Unable to parse address: %v", r.Address)
 		}
 
-		if r.Options["RequestAddressType"] == "com.docker.network.gateway" {
+		if r.Options["RequestAddressType"] == gatewayOption {
 			log.Debugf("Gateway requested, approving")
 			res.Address = addr.String()
 			return res, nil
 		}
 
-		err = d.tryAddress(addr, 8*time.Second)
+		err = d.tryAddress(ctx, p, addr, true, mac)
 		if err != nil {
 			log.WithError(err).Error("Error getting specific address")
 			return nil, err
 		}
+		if err := d.lease(p, addr.IP); err != nil {
+			d.leases.drop(p.id(), addr.IP)
+			return nil, err
+		}
+		// Don't allocate an address the caller has given up on
+		if err := ctx.Err(); err != nil {
+			d.abandon(p, addr.IP)
+			return nil, err
+		}
+		if err := d.ledger.add(r.PoolID, addr.IP, r.Options); err != nil {
+			d.abandon(p, addr.IP)
+			return nil, err
+		}
+		d.allocated(p, addr, mac)
 
 		res.Address = addr.String()
 		return res, nil
 	}
 
 	log.Debugf("Random Address Requested in network %v", n)
-	retAddr, err := d.getRandomUnusedAddr(n, 8*time.Second)
-	if err != nil {
-		log.WithError(err).Error("Error getting random address")
+	var retAddr *net.IPNet
+	if mac != nil {
+		retAddr = d.stickyAddr(ctx, p, mac)
+		if retAddr != nil && d.lease(p, retAddr.IP) != nil {
+			d.leases.drop(p.id(), retAddr.IP)
+			retAddr = nil
+		}
+	}
+	for i := 1; retAddr == nil; i++ {
+		retAddr, err = d.getRandomUnusedAddr(ctx, p)
+		if err != nil {
+			log.WithError(err).Error("Error getting random address")
+			return nil, err
+		}
+		if err = d.lease(p, retAddr.IP); err != nil {
+			d.leases.drop(p.id(), retAddr.IP)
+			if i >= leaseAttempts {
+				return nil, err
+			}
+			retAddr = nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		d.abandon(p, retAddr.IP)
+		return nil, err
+	}
+	if err := d.ledger.add(r.PoolID, retAddr.IP, r.Options); err != nil {
+		d.abandon(p, retAddr.IP)
 		return nil, err
 	}
+	d.allocated(p, retAddr, mac)
 	res.Address = retAddr.String()
 	log.WithField("Address", res.Address).Debug("Responding with address")
 	return res, nil
@@ -231,21 +670,61 @@ func (d *Driver) requestAddress(r *ipam.RequestAddressRequest) (*ipam.RequestAdd
 // ReleaseAddress releases an assigned address
 func (d *Driver) ReleaseAddress(r *ipam.ReleaseAddressRequest) error {
 	log.Debugf("ReleaseAddress: %v", r)
-	ip := net.ParseIP(r.Address)
-	log.Debugf("Deleting entry from arp table for %v", ip)
-	neighs, err := netlink.NeighList(0, netlink.FAMILY_ALL)
+	done, err := d.begin()
 	if err != nil {
-		log.WithError(err).Error("Failed to get arp table")
 		return err
 	}
-	for _, n := range neighs {
-		if ip.Equal(n.IP) {
-			err := netlink.NeighDel(&n)
-			if err != nil {
-				log.WithError(err).WithField("ip", ip).Error("Failed to delete arp entry.")
+	defer done()
+	ip := net.ParseIP(r.Address)
+	if ip == nil {
+		log.Errorf("Unable to parse address: %v", r.Address)
+		return fmt.Errorf("Unable to parse address: %v", r.Address)
+	}
+	p, perr := d.getPool(r.PoolID)
+	// Release the lease first, so a failure leaves the allocation to be released again
+	if perr == nil {
+		if err := d.release(p, ip); err != nil {
+			if _, ok := err.(*leasedError); !ok {
+				return err
 			}
+			log.WithError(err).WithField("ip", ip).Warn("Lease on released address held by another owner")
+		}
+	}
+	d.unwatchAddress(r.PoolID, ip)
+	if err := d.ledger.del(r.PoolID, ip); err != nil {
+		return err
+	}
+	if perr == nil && p.cfg.quarantine > 0 {
+		log.WithField("ip", ip).WithField("quarantine", p.cfg.quarantine).Debug("Quarantining released address")
+		if err := d.ledger.addQuarantine(r.PoolID, ip, time.Now().Add(p.cfg.quarantine)); err != nil {
 			return err
 		}
 	}
-	return nil
+	return flushNeigh(ip)
+}
+
+// abandon gives up ip after it was chosen for a request that failed, so it can
+// be chosen again without waiting for its local lease to expire
+func (d *Driver) abandon(p *pool, ip net.IP) {
+	d.leases.drop(p.id(), ip)
+	d.release(p, ip)
+}
+
+// allocated prepares the network for a newly allocated address. The endpoint
+// MAC is remembered if known, any stale neighbor entry is flushed, the address
+// is watched for conflicts, and it is announced once the endpoint appears if the
+// pool is configured to.
+func (d *Driver) allocated(p *pool, addr *net.IPNet, mac net.HardwareAddr) {
+	if mac != nil {
+		if err := d.ledger.setMAC(mac, p.id(), addr.IP); err != nil {
+			log.WithError(err).WithField("ip", addr.IP).WithField("mac", mac).Warn("Error recording MAC for allocated address")
+		}
+	}
+	if err := flushNeigh(addr.IP); err != nil {
+		log.WithError(err).WithField("ip", addr.IP).Warn("Error flushing neighbor entry for allocated address")
+	}
+	d.watchAddress(p.id(), addr, mac)
+	if p.cfg.announce {
+		go d.announce(addr, mac)
+	}
 }
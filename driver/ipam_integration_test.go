@@ -0,0 +1,136 @@
+//go:build integration
+// +build integration
+
+package driver
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// testLink sets up testVeth with 198.51.100.10/24 and a default route via
+// 198.51.100.1 in a namespace of its own, so the host isn't touched. The
+// returned func switches back to the host namespace.
+func testLink(t *testing.T) func() {
+	// Everything runs on this thread in the new namespace
+	runtime.LockOSThread()
+	host, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		host.Close()
+		runtime.UnlockOSThread()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		netns.Set(host)
+		ns.Close()
+		host.Close()
+		runtime.UnlockOSThread()
+	}
+
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: testVeth}, PeerName: testVethPeer}); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	link, err := netlink.LinkByName(testVeth)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseAddr("198.51.100.10/24")
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("198.51.100.1")}); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return cleanup
+}
+
+func TestAutoPoolGateway(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Requires root")
+	}
+	defer testLink(t)()
+
+	quit := make(chan struct{})
+	defer close(quit)
+	d, err := NewDriver(quit, &Options{Probe: ProbeUDP, AutoPoolInterfaces: []string{testVeth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.RequestPool(&ipam.RequestPoolRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Pool != "198.51.100.0/24" {
+		t.Errorf("Pool %v, want 198.51.100.0/24", r.Pool)
+	}
+	if gw := r.Data[gatewayOption]; gw != "198.51.100.1/24" {
+		t.Errorf("Gateway %q, want 198.51.100.1/24", gw)
+	}
+}
+
+// blockingProber never answers until its probe is cancelled
+type blockingProber struct{}
+
+func (blockingProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func (p blockingProber) ProbeExcept(ctx context.Context, addr *net.IPNet, to time.Duration, mac net.HardwareAddr) (bool, error) {
+	return p.Probe(ctx, addr, to)
+}
+
+func TestRequestAddressCancelled(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Requires root")
+	}
+	defer testLink(t)()
+
+	quit := make(chan struct{})
+	defer close(quit)
+	d, err := NewDriver(quit, &Options{Probe: ProbeUDP, AutoPoolInterfaces: []string{testVeth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.RequestPool(&ipam.RequestPoolRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := d.getPool(r.PoolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.prober = blockingProber{}
+
+	// The client goes away well before the request would time out
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	st := time.Now()
+	if _, err := d.requestAddressContext(ctx, &ipam.RequestAddressRequest{PoolID: r.PoolID}); err == nil {
+		t.Fatal("Cancelled request returned an address")
+	}
+	if el := time.Since(st); el >= p.cfg.requestTimeout {
+		t.Errorf("Cancelled request took %v, want under %v", el, p.cfg.requestTimeout)
+	}
+}
@@ -0,0 +1,32 @@
+package driver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestRouteGateway(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	_, other, _ := net.ParseCIDR("192.168.0.0/16")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	for _, tc := range []struct {
+		name   string
+		routes []netlink.Route
+		gw     string
+	}{
+		{"none", nil, ""},
+		{"link only", []netlink.Route{{Dst: n}}, ""},
+		{"default", []netlink.Route{{Dst: n}, {Gw: net.ParseIP("10.0.0.1")}}, "10.0.0.1"},
+		{"default as 0/0", []netlink.Route{{Dst: all, Gw: net.ParseIP("10.0.0.1")}}, "10.0.0.1"},
+		{"prefers default", []netlink.Route{{Dst: other, Gw: net.ParseIP("10.0.0.2")}, {Gw: net.ParseIP("10.0.0.1")}}, "10.0.0.1"},
+		{"other route", []netlink.Route{{Dst: other, Gw: net.ParseIP("10.0.0.2")}}, "10.0.0.2"},
+		{"gateway outside the pool", []netlink.Route{{Gw: net.ParseIP("10.0.1.1")}}, ""},
+	} {
+		gw := routeGateway(tc.routes, n)
+		if (gw == nil && tc.gw != "") || (gw != nil && !gw.Equal(net.ParseIP(tc.gw))) {
+			t.Errorf("%v: gateway %v, want %q", tc.name, gw, tc.gw)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// localLeases are short lived claims on addresses between choosing an address
+// for a request and recording it in the ledger, so concurrent requests never
+// choose the same address
+type localLeases struct {
+	lock   sync.Mutex
+	leases map[string]time.Time // map of pool and IP to lease expiry
+}
+
+func newLocalLeases() *localLeases {
+	return &localLeases{leases: make(map[string]time.Time)}
+}
+
+// take leases ip in pool for ttl, returning false if it is already leased
+func (l *localLeases) take(pool string, ip net.IP, ttl time.Duration) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for k, exp := range l.leases {
+		if !now.Before(exp) {
+			delete(l.leases, k)
+		}
+	}
+	k := addrKey(pool, ip)
+	if _, ok := l.leases[k]; ok {
+		return false
+	}
+	l.leases[k] = now.Add(ttl)
+	return true
+}
+
+// held returns true if ip in pool is leased
+func (l *localLeases) held(pool string, ip net.IP) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	exp, ok := l.leases[addrKey(pool, ip)]
+	return ok && time.Now().Before(exp)
+}
+
+// drop releases the lease on ip in pool
+func (l *localLeases) drop(pool string, ip net.IP) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.leases, addrKey(pool, ip))
+}
@@ -0,0 +1,334 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	ledgerFile     = "allocations.json"
+	poolsFile      = "pools.json"
+	quarantineFile = "quarantine.json"
+	macsFile       = "macs.json"
+)
+
+type allocation struct {
+	Pool    string            `json:"pool"`
+	Address string            `json:"address"`
+	Options map[string]string `json:"options,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+// macRecord is the address last allocated to a MAC
+type macRecord struct {
+	Pool    string    `json:"pool"`
+	Address string    `json:"address"`
+	Updated time.Time `json:"updated"`
+}
+
+// ledger records the addresses handed out by the driver and the options of
+// each pool. If a state directory is configured the ledger is persisted there
+// so it survives restarts. Allocations are only removed when released, one
+// docker never released can be released through the admin API.
+type ledger struct {
+	dir        string
+	readOnly   bool // never create or write dir
+	lock       sync.Mutex
+	allocs     map[string]*allocation       // map of pool and IP to allocation
+	pools      map[string]map[string]string // map of pool ID to options
+	quarantine map[string]time.Time         // map of pool and released IP to the time it may be given out randomly again
+	macs       map[string]*macRecord        // map of pool and MAC to its last address
+}
+
+// addrKey keys state about ip in pool, so pools in different address spaces
+// may overlap
+func addrKey(pool string, ip net.IP) string {
+	return pool + "|" + ip.String()
+}
+
+func macKey(pool string, mac net.HardwareAddr) string {
+	return pool + "|" + mac.String()
+}
+
+func newLedger(stateDir string, readOnly bool) (*ledger, error) {
+	l := &ledger{
+		dir:      stateDir,
+		readOnly: readOnly,
+		allocs:   make(map[string]*allocation),
+		pools:    make(map[string]map[string]string),
+
+		quarantine: make(map[string]time.Time),
+		macs:       make(map[string]*macRecord),
+	}
+	if stateDir == "" {
+		log.Warn("No state directory, allocations will not be persisted")
+		return l, nil
+	}
+	if readOnly {
+		if _, err := os.Stat(stateDir); os.IsNotExist(err) {
+			log.WithField("dir", stateDir).Debug("No state directory, no allocations to load")
+			return l, nil
+		}
+	} else if err := os.MkdirAll(stateDir, 0700); err != nil {
+		log.WithError(err).WithField("dir", stateDir).Error("Error creating state directory")
+		return nil, err
+	}
+
+	if err := l.load(poolsFile, &l.pools); err != nil {
+		return nil, err
+	}
+	if err := l.load(quarantineFile, &l.quarantine); err != nil {
+		return nil, err
+	}
+	if err := l.load(macsFile, &l.macs); err != nil {
+		return nil, err
+	}
+	var allocs []*allocation
+	if err := l.load(ledgerFile, &allocs); err != nil {
+		return nil, err
+	}
+	for _, a := range allocs {
+		ip := net.ParseIP(a.Address)
+		if ip == nil {
+			log.WithField("address", a.Address).Warn("Ignoring unparsable address in allocations")
+			continue
+		}
+		l.allocs[addrKey(a.Pool, ip)] = a
+	}
+	log.WithField("allocations", len(l.allocs)).WithField("pools", len(l.pools)).Debug("Loaded ledger")
+	return l, nil
+}
+
+// load reads a file from the state directory into v. A missing file is not an error.
+func (l *ledger) load(file string, v interface{}) error {
+	path := filepath.Join(l.dir, file)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.WithError(err).WithField("file", path).Error("Error reading ledger")
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		log.WithError(err).WithField("file", path).Error("Error parsing ledger")
+		return err
+	}
+	return nil
+}
+
+func (l *ledger) get(pool string, ip net.IP) *allocation {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.allocs[addrKey(pool, ip)]
+}
+
+// find returns the allocations of ip in every pool
+func (l *ledger) find(ip net.IP) []*allocation {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var allocs []*allocation
+	for _, a := range l.allocs {
+		if net.ParseIP(a.Address).Equal(ip) {
+			allocs = append(allocs, a)
+		}
+	}
+	return allocs
+}
+
+func (l *ledger) add(pool string, ip net.IP, opts map[string]string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	k := addrKey(pool, ip)
+	prev, ok := l.allocs[k]
+	l.allocs[k] = &allocation{
+		Pool:    pool,
+		Address: ip.String(),
+		Options: opts,
+		Created: time.Now(),
+	}
+	if err := l.save(); err != nil {
+		// The caller abandons the address, so don't keep it allocated
+		if ok {
+			l.allocs[k] = prev
+		} else {
+			delete(l.allocs, k)
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *ledger) del(pool string, ip net.IP) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	k := addrKey(pool, ip)
+	prev, ok := l.allocs[k]
+	if !ok {
+		return nil
+	}
+	delete(l.allocs, k)
+	if err := l.save(); err != nil {
+		// Keep it allocated so the release can be retried
+		l.allocs[k] = prev
+		return err
+	}
+	return nil
+}
+
+// setMAC records ip as the last address allocated to mac in pool. Only the
+// latest MAC is kept for each address.
+func (l *ledger) setMAC(mac net.HardwareAddr, pool string, ip net.IP) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for k, r := range l.macs {
+		if r.Pool == pool && r.Address == ip.String() {
+			delete(l.macs, k)
+		}
+	}
+	l.macs[macKey(pool, mac)] = &macRecord{
+		Pool:    pool,
+		Address: ip.String(),
+		Updated: time.Now(),
+	}
+	return l.write(macsFile, l.macs)
+}
+
+// macAddress returns the address last allocated to mac in pool, or nil
+func (l *ledger) macAddress(pool string, mac net.HardwareAddr) net.IP {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if r, ok := l.macs[macKey(pool, mac)]; ok {
+		return net.ParseIP(r.Address)
+	}
+	return nil
+}
+
+// addQuarantine keeps ip in pool from being given out randomly until the given time
+func (l *ledger) addQuarantine(pool string, ip net.IP, until time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.quarantine[addrKey(pool, ip)] = until
+	return l.saveQuarantine()
+}
+
+// quarantined returns true if ip in pool was released too recently to be given
+// out randomly
+func (l *ledger) quarantined(pool string, ip net.IP) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	k := addrKey(pool, ip)
+	until, ok := l.quarantine[k]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(l.quarantine, k)
+	if err := l.saveQuarantine(); err != nil {
+		log.WithError(err).Warn("Error saving quarantine")
+	}
+	return false
+}
+
+// saveQuarantine writes the quarantine to disk, dropping expired entries. The
+// caller must hold the lock.
+func (l *ledger) saveQuarantine() error {
+	now := time.Now()
+	for ip, until := range l.quarantine {
+		if !now.Before(until) {
+			delete(l.quarantine, ip)
+		}
+	}
+	return l.write(quarantineFile, l.quarantine)
+}
+
+// list returns every allocation
+func (l *ledger) list() []*allocation {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	allocs := make([]*allocation, 0, len(l.allocs))
+	for _, a := range l.allocs {
+		allocs = append(allocs, a)
+	}
+	return allocs
+}
+
+// poolCounts returns the number of allocations in each pool
+func (l *ledger) poolCounts() map[string]int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	counts := make(map[string]int)
+	for _, a := range l.allocs {
+		counts[a.Pool]++
+	}
+	return counts
+}
+
+// poolOptions returns the options of every pool in the ledger
+func (l *ledger) poolOptions() map[string]map[string]string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	pools := make(map[string]map[string]string, len(l.pools))
+	for id, opts := range l.pools {
+		pools[id] = opts
+	}
+	return pools
+}
+
+func (l *ledger) addPool(id string, opts map[string]string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.pools[id] = opts
+	return l.write(poolsFile, l.pools)
+}
+
+func (l *ledger) delPool(id string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.pools[id]; !ok {
+		return nil
+	}
+	delete(l.pools, id)
+	return l.write(poolsFile, l.pools)
+}
+
+// save writes the allocations to disk, the caller must hold the lock
+func (l *ledger) save() error {
+	allocs := make([]*allocation, 0, len(l.allocs))
+	for _, a := range l.allocs {
+		allocs = append(allocs, a)
+	}
+	return l.write(ledgerFile, allocs)
+}
+
+// write writes v to a file in the state directory, the caller must hold the lock
+func (l *ledger) write(file string, v interface{}) error {
+	if l.dir == "" || l.readOnly {
+		return nil
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file and rename so a crash never leaves a partial ledger
+	path := filepath.Join(l.dir, file)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		log.WithError(err).WithField("file", tmp).Error("Error writing ledger")
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.WithError(err).WithField("file", path).Error("Error saving ledger")
+		return err
+	}
+	return nil
+}
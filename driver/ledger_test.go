@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedgerOverlappingPools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp-ipam-ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := newLedger(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("10.0.0.5")
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	a, b := "10.0.0.0/24", "lab/10.0.0.0/24"
+	if err := l.add(a, ip, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.setMAC(mac, a, ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.addQuarantine(a, net.ParseIP("10.0.0.6"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload from disk, then check the pools are independent
+	if l, err = newLedger(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if l.get(a, ip) == nil || l.get(b, ip) != nil {
+		t.Error("Allocation is not kept to its pool")
+	}
+	if !l.macAddress(a, mac).Equal(ip) || l.macAddress(b, mac) != nil {
+		t.Error("MAC address is not kept to its pool")
+	}
+	if !l.quarantined(a, net.ParseIP("10.0.0.6")) || l.quarantined(b, net.ParseIP("10.0.0.6")) {
+		t.Error("Quarantine is not kept to its pool")
+	}
+	if err := l.add(b, ip, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.del(a, ip); err != nil {
+		t.Fatal(err)
+	}
+	if l.get(a, ip) != nil || l.get(b, ip) == nil {
+		t.Error("Releasing an address released it in another pool")
+	}
+}
+
+func TestLedgerReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp-ipam-ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := filepath.Join(dir, "state")
+	l, err := newLedger(state, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.add("10.0.0.0/24", net.ParseIP("10.0.0.5"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("Read only ledger created its state directory: %v", err)
+	}
+}
+
+func TestLedgerAddFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp-ipam-ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newLedger(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes fail once the state directory is gone
+	os.RemoveAll(dir)
+	ip := net.ParseIP("10.0.0.5")
+	if err := l.add("10.0.0.0/24", ip, nil); err == nil {
+		t.Fatal("Add succeeded without a state directory")
+	}
+	if l.get("10.0.0.0/24", ip) != nil {
+		t.Error("Address is allocated after failing to save it")
+	}
+}
+
+func TestLedgerDelFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp-ipam-ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := newLedger(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("10.0.0.5")
+	if err := l.add("10.0.0.0/24", ip, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Writes fail once the state directory is gone
+	os.RemoveAll(dir)
+	if err := l.del("10.0.0.0/24", ip); err == nil {
+		t.Fatal("Delete succeeded without a state directory")
+	}
+	if l.get("10.0.0.0/24", ip) == nil {
+		t.Error("Address is released after failing to save it")
+	}
+}
@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// optMACAddress is the request option docker sets to the endpoint MAC
+const optMACAddress = "com.docker.network.endpoint.macaddress"
+
+// requestMAC returns the endpoint MAC from request options, or nil
+func requestMAC(opts map[string]string) net.HardwareAddr {
+	s, ok := opts[optMACAddress]
+	if !ok || s == "" {
+		return nil
+	}
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		log.WithError(err).WithField("mac", s).Warn("Ignoring unparsable endpoint MAC")
+		return nil
+	}
+	return mac
+}
+
+// stickyAddr returns the address mac held last in p if it is still free and
+// could be given out randomly under the current pool config. The driver's own
+// record is preferred, falling back to the neighbor table.
+func (d *Driver) stickyAddr(ctx context.Context, p *pool, mac net.HardwareAddr) *net.IPNet {
+	rng := p.randRange()
+	ip := d.ledger.macAddress(p.id(), mac)
+	if ip == nil || !rng.Contains(ip) {
+		ip = neighByMAC(mac, rng)
+	}
+	if ip == nil {
+		return nil
+	}
+	w, err := newAddrWalker(p)
+	if err != nil || !w.contains(ip) || d.excluded(p, ip) {
+		log.WithField("mac", mac).WithField("ip", ip).Debug("Previous address for MAC excluded from pool")
+		return nil
+	}
+	addr := &net.IPNet{IP: ip, Mask: p.Mask}
+	if err := d.tryAddress(ctx, p, addr, false, mac); err != nil {
+		log.WithError(err).WithField("mac", mac).WithField("ip", ip).Debug("Previous address for MAC unavailable")
+		return nil
+	}
+	return addr
+}
+
+// neighByMAC returns an address in n the neighbor table has at mac, or nil
+func neighByMAC(mac net.HardwareAddr, n *net.IPNet) net.IP {
+	neighs, err := netlink.NeighList(0, ipFamily(n.IP))
+	if err != nil {
+		log.WithError(err).Error("Error refreshing neighbor table.")
+		return nil
+	}
+	for _, ne := range neighs {
+		if bytes.Equal(ne.HardwareAddr, mac) && n.Contains(ne.IP) {
+			return ne.IP
+		}
+	}
+	return nil
+}
+
+// ownedBy returns true if the neighbor table has ip at mac
+func ownedBy(ip net.IP, mac net.HardwareAddr) bool {
+	n, err := getNeigh(ip)
+	if err != nil || n == nil {
+		return false
+	}
+	return bytes.Equal(n.HardwareAddr, mac)
+}
@@ -0,0 +1,31 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestStickyAddrExcluded(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	c := testConfig()
+	c.prober = freeProber{}
+	d, p, _ := testCandidates(t, quit, "10.0.0.0/24", c)
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	if err := d.ledger.setMAC(mac, p.id(), net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := d.stickyAddr(context.Background(), p, mac)
+	if r == nil || !r.IP.Equal(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("Sticky address %v, want 10.0.0.3", r)
+	}
+	d.leases.drop(p.id(), r.IP)
+
+	// The pool options changed so the remembered address is excluded
+	p.cfg.excludeFirst = 5
+	if r := d.stickyAddr(context.Background(), p, mac); r != nil {
+		t.Errorf("Sticky address %v excluded by exclude-first", r)
+	}
+}
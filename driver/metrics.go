@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+)
+
+const metricsNamespace = "arp_ipam"
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_address_duration_seconds",
+		Help:      "Time taken to serve RequestAddress by outcome.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2, 4, 8, 16},
+	}, []string{"outcome"})
+
+	probeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "probe_duration_seconds",
+		Help:      "Time taken to probe an address by method and result.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2, 4, 8, 16},
+	}, []string{"method", "result"})
+
+	neighProbeStates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "neighbor_probe_states_total",
+		Help:      "Neighbor state which decided the outcome of neighbor table probes.",
+	}, []string{"state"})
+
+	candidatePops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "candidate_pops_total",
+		Help:      "Random address requests served from the candidate list (hit) or not (miss).",
+	}, []string{"result"})
+
+	activeSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "neighbor_subscriptions",
+		Help:      "Active neighbor table subscriptions.",
+	})
+
+	poolInUseRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pool_in_use_ratio",
+		Help:      "Fraction of addresses found in use during the last random allocation in a pool.",
+	}, []string{"pool"})
+
+	poolFreeEstimate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pool_free_addresses_estimate",
+		Help:      "Estimated free addresses in a pool based on the last random allocation.",
+	}, []string{"pool"})
+
+	addressConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "address_conflicts_total",
+		Help:      "Allocated addresses seen at a MAC other than their endpoint's.",
+	}, []string{"pool"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestDuration,
+		probeDuration,
+		neighProbeStates,
+		candidatePops,
+		activeSubscriptions,
+		poolInUseRatio,
+		poolFreeEstimate,
+		addressConflicts,
+	)
+}
+
+// deletePoolMetrics drops the series of a released pool
+func deletePoolMetrics(id string) {
+	poolInUseRatio.DeleteLabelValues(id)
+	poolFreeEstimate.DeleteLabelValues(id)
+	addressConflicts.DeleteLabelValues(id)
+}
+
+// Probe results
+const (
+	probeReachable   = "reachable"
+	probeUnreachable = "unreachable"
+	probeTimeout     = "timeout"
+	probeError       = "error"
+	probeCancelled   = "cancelled"
+)
+
+// instrumentedProber records the duration and result of each probe
+type instrumentedProber struct {
+	method string
+	Prober
+}
+
+func (p *instrumentedProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	st := time.Now()
+	r, err := p.Prober.Probe(ctx, addr, to)
+	p.observe(st, r, err)
+	return r, err
+}
+
+func (p *instrumentedProber) ProbeExcept(ctx context.Context, addr *net.IPNet, to time.Duration, mac net.HardwareAddr) (bool, error) {
+	st := time.Now()
+	r, err := probeExcept(ctx, p.Prober, addr, to, mac)
+	p.observe(st, r, err)
+	return r, err
+}
+
+// observe records a probe started at st with result r and err
+func (p *instrumentedProber) observe(st time.Time, r bool, err error) {
+	result := probeUnreachable
+	switch {
+	case err != nil:
+		result = probeError
+		if _, ok := err.(*probeTimeoutError); ok {
+			result = probeTimeout
+		}
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			result = probeCancelled
+		}
+	case r:
+		result = probeReachable
+	}
+	probeDuration.WithLabelValues(p.method, result).Observe(time.Since(st).Seconds())
+}
+
+// neighStateName returns the name of a neighbor state for metrics
+func neighStateName(n *netlink.Neigh) string {
+	if n == nil {
+		return "none"
+	}
+	switch n.State {
+	case netlink.NUD_INCOMPLETE:
+		return "INCOMPLETE"
+	case netlink.NUD_REACHABLE:
+		return "REACHABLE"
+	case netlink.NUD_STALE:
+		return "STALE"
+	case netlink.NUD_DELAY:
+		return "DELAY"
+	case netlink.NUD_PROBE:
+		return "PROBE"
+	case netlink.NUD_FAILED:
+		return "FAILED"
+	case netlink.NUD_NOARP:
+		return "NOARP"
+	case netlink.NUD_PERMANENT:
+		return "PERMANENT"
+	}
+	return "NONE"
+}
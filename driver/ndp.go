@@ -0,0 +1,79 @@
+package driver
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	icmpv6NeighborSolicitation  = 135
+	icmpv6NeighborAdvertisement = 136
+	ndpOptSourceLinkAddr        = 1
+	ndpOptTargetLinkAddr        = 2
+	ndpFlagOverride             = 0x20
+)
+
+var allNodesAddr = net.ParseIP("ff02::1")
+
+// solicitedNodeAddr returns the solicited-node multicast address for ip
+func solicitedNodeAddr(ip net.IP) net.IP {
+	ip = ip.To16()
+	return net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, ip[13], ip[14], ip[15]}
+}
+
+// sendNeighborSolicitation sends an ICMPv6 neighbor solicitation for ip out the local link in its network
+func sendNeighborSolicitation(ip net.IP) error {
+	link, _, err := localLink(ip)
+	if err != nil {
+		return err
+	}
+
+	// type, code, checksum (filled in by the kernel), reserved, target
+	msg := make([]byte, 8, 32)
+	msg[0] = icmpv6NeighborSolicitation
+	msg = append(msg, ip.To16()...)
+	if mac := link.Attrs().HardwareAddr; len(mac) == 6 {
+		msg = append(msg, ndpOptSourceLinkAddr, 1)
+		msg = append(msg, mac...)
+	}
+	return sendNDP(link.Attrs().Index, solicitedNodeAddr(ip), msg)
+}
+
+// sendUnsolicitedNA advertises to all nodes on the local link in the network
+// of ip that ip is at mac, overriding existing cache entries
+func sendUnsolicitedNA(ip net.IP, mac net.HardwareAddr) error {
+	link, _, err := localLink(ip)
+	if err != nil {
+		return err
+	}
+
+	// type, code, checksum (filled in by the kernel), flags, reserved, target
+	msg := make([]byte, 8, 32)
+	msg[0] = icmpv6NeighborAdvertisement
+	msg[4] = ndpFlagOverride
+	msg = append(msg, ip.To16()...)
+	msg = append(msg, ndpOptTargetLinkAddr, 1)
+	msg = append(msg, mac...)
+	return sendNDP(link.Attrs().Index, allNodesAddr, msg)
+}
+
+// sendNDP sends a neighbor discovery message to a multicast group out a link
+func sendNDP(ifIndex int, dst net.IP, msg []byte) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// RFC 4861 requires a hop limit of 255 on all neighbor discovery messages
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifIndex); err != nil {
+		return err
+	}
+
+	sa := &syscall.SockaddrInet6{ZoneId: uint32(ifIndex)}
+	copy(sa.Addr[:], dst.To16())
+	return syscall.Sendto(fd, msg, 0, sa)
+}
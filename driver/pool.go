@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// pool is an address pool in an address space. Random addresses are only
+// chosen from sub if it is set.
+type pool struct {
+	*net.IPNet
+	sub   *net.IPNet
+	space string
+	cfg   *poolConfig
+}
+
+func newPool(p, sub string) (*pool, error) {
+	n, err := netlink.ParseIPNet(p)
+	if err != nil {
+		return nil, err
+	}
+	if sub == "" {
+		return &pool{IPNet: n, space: DefaultAddressSpace}, nil
+	}
+	s, err := netlink.ParseIPNet(sub)
+	if err != nil {
+		return nil, err
+	}
+	s.IP = s.IP.Mask(s.Mask)
+	pOnes, pBits := n.Mask.Size()
+	sOnes, sBits := s.Mask.Size()
+	if pBits != sBits || sOnes < pOnes || !n.Contains(s.IP) {
+		return nil, fmt.Errorf("SubPool %v is not within pool %v", s, n)
+	}
+	return &pool{IPNet: n, sub: s, space: DefaultAddressSpace}, nil
+}
+
+// parsePoolID parses a pool ID as returned by id
+func parsePoolID(id string) (*pool, error) {
+	// a pool is <addr>/<mask>, optionally followed by a sub pool of the same
+	// form. Pools outside the default address space are prefixed by <space>/
+	space := DefaultAddressSpace
+	parts := strings.Split(id, "/")
+	if len(parts)%2 == 1 {
+		space, parts = parts[0], parts[1:]
+	}
+	var p *pool
+	var err error
+	switch len(parts) {
+	case 2:
+		p, err = newPool(parts[0]+"/"+parts[1], "")
+	case 4:
+		p, err = newPool(parts[0]+"/"+parts[1], parts[2]+"/"+parts[3])
+	default:
+		return nil, fmt.Errorf("Invalid pool ID: %v", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.space = space
+	return p, nil
+}
+
+// id returns the pool ID given to docker
+func (p *pool) id() string {
+	id := p.IPNet.String()
+	if p.sub != nil {
+		id += "/" + p.sub.String()
+	}
+	if p.space != DefaultAddressSpace {
+		id = p.space + "/" + id
+	}
+	return id
+}
+
+// randRange returns the network random addresses are chosen from
+func (p *pool) randRange() *net.IPNet {
+	if p.sub != nil {
+		return p.sub
+	}
+	return p.IPNet
+}
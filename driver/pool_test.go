@@ -0,0 +1,60 @@
+package driver
+
+import "testing"
+
+func TestPoolIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		id    string
+		space string
+		pool  string
+		sub   string
+	}{
+		{"10.0.0.0/24", DefaultAddressSpace, "10.0.0.0/24", ""},
+		{"10.0.0.0/24/10.0.0.128/25", DefaultAddressSpace, "10.0.0.0/24", "10.0.0.128/25"},
+		{"lab/10.0.0.0/24", "lab", "10.0.0.0/24", ""},
+		{"lab/10.0.0.0/24/10.0.0.128/25", "lab", "10.0.0.0/24", "10.0.0.128/25"},
+		{"fd00::/64", DefaultAddressSpace, "fd00::/64", ""},
+		{"lab/fd00::/64/fd00::/96", "lab", "fd00::/64", "fd00::/96"},
+	}
+	for _, tt := range tests {
+		p, err := parsePoolID(tt.id)
+		if err != nil {
+			t.Errorf("parsePoolID(%q): %v", tt.id, err)
+			continue
+		}
+		if p.space != tt.space {
+			t.Errorf("parsePoolID(%q) space = %q, want %q", tt.id, p.space, tt.space)
+		}
+		if p.IPNet.String() != tt.pool {
+			t.Errorf("parsePoolID(%q) pool = %v, want %v", tt.id, p.IPNet, tt.pool)
+		}
+		sub := ""
+		if p.sub != nil {
+			sub = p.sub.String()
+		}
+		if sub != tt.sub {
+			t.Errorf("parsePoolID(%q) sub = %q, want %q", tt.id, sub, tt.sub)
+		}
+		if p.id() != tt.id {
+			t.Errorf("parsePoolID(%q).id() = %q", tt.id, p.id())
+		}
+	}
+}
+
+func TestParsePoolIDInvalid(t *testing.T) {
+	for _, id := range []string{
+		"",
+		"10.0.0.0",
+		"lab/10.0.0.0",
+		"10.0.0.0/24/10.0.0.0",
+		"a/b/10.0.0.0/24/10.0.0.0/25/x",
+		"10.0.0.0/24/10.0.1.0/25", // sub pool outside the pool
+		"10.0.0.0/24/10.0.0.0/16", // sub pool larger than the pool
+		"10.0.0.0/24/fd00::/64",   // mixed families
+		"not-an-ip/24",
+	} {
+		if p, err := parsePoolID(id); err == nil {
+			t.Errorf("parsePoolID(%q) = %v, want an error", id, p.id())
+		}
+	}
+}
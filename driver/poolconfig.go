@@ -0,0 +1,181 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Pool options accepted from docker network create --ipam-opt
+const (
+	optPrefix           = "arp-ipam."
+	OptExcludeFirst     = optPrefix + "exclude-first"
+	OptExcludeLast      = optPrefix + "exclude-last"
+	OptExclude          = optPrefix + "exclude"
+	OptReserve          = optPrefix + "reserve"
+	OptProbe            = optPrefix + "probe"
+	OptProbeTimeout     = optPrefix + "probe-timeout"
+	OptCandidateTimeout = optPrefix + "candidate-timeout"
+	OptRequestTimeout   = optPrefix + "request-timeout"
+	OptCandidates       = optPrefix + "candidates"
+	OptSweepInterval    = optPrefix + "sweep-interval"
+	OptSweepRate        = optPrefix + "sweep-rate"
+	OptQuarantine       = optPrefix + "quarantine"
+	OptAnnounce         = optPrefix + "announce"
+)
+
+// OptForce lists reserved addresses of a pool which may still be requested
+// specifically, with docker run --ip or network create --aux-address. Docker
+// passes no options of its own to an endpoint's request, so this is set on the
+// pool. Forced addresses are still never given out randomly.
+const OptForce = optPrefix + "force"
+
+// Default timeouts
+const (
+	defaultProbeTimeout     = 8 * time.Second
+	defaultCandidateTimeout = 15 * time.Second
+	defaultRequestTimeout   = 10 * time.Second
+)
+
+// poolConfig is the configuration for a single pool
+type poolConfig struct {
+	excludeFirst     int
+	excludeLast      int
+	exclude          ipRanges // never given out randomly
+	reserved         ipRanges // never given out randomly or by request unless forced
+	force            ipRanges // reserved addresses which may be requested specifically
+	probe            string
+	prober           Prober
+	probeTimeout     time.Duration // timeout probing addresses while serving a request
+	candidateTimeout time.Duration // timeout probing candidate addresses in the background
+	requestTimeout   time.Duration // timeout for an entire request
+	candidates       int           // number of candidate addresses to keep ready
+	sweepInterval    time.Duration // time between sweeps of the pool, zero to never sweep
+	sweepRate        int           // addresses probed per second while sweeping
+	quarantine       time.Duration // time a released address is not given out randomly
+	announce         bool          // announce allocated addresses once their endpoint appears
+}
+
+// newPoolConfig returns the config for p, starting from the driver defaults,
+// applying the options of the pool's address space, the probe method from the
+// flags and the options from the configuration file for its network, then opts
+// over them
+func (d *Driver) newPoolConfig(p *pool, opts map[string]string) (*poolConfig, error) {
+	d.cfgLock.RLock()
+	c := d.defaults
+	n := &net.IPNet{IP: p.IP.Mask(p.Mask), Mask: p.Mask}
+	fileOpts := d.poolOpts[n.String()]
+	d.cfgLock.RUnlock()
+	if err := c.apply(d.spaces[p.space]); err != nil {
+		return nil, err
+	}
+	if m, ok := d.poolProbes[n.String()]; ok {
+		c.probe = m
+	}
+	if err := c.apply(fileOpts); err != nil {
+		return nil, err
+	}
+	if err := c.apply(opts); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if c.prober, err = d.newProber(c.probe); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// apply parses opts into c
+func (c *poolConfig) apply(opts map[string]string) error {
+	var err error
+	for k, v := range opts {
+		if !strings.HasPrefix(k, optPrefix) {
+			continue
+		}
+		switch k {
+		case OptExcludeFirst:
+			c.excludeFirst, err = strconv.Atoi(v)
+		case OptExcludeLast:
+			c.excludeLast, err = strconv.Atoi(v)
+		case OptExclude:
+			c.exclude, err = parseRanges(v)
+		case OptReserve:
+			c.reserved, err = parseRanges(v)
+		case OptProbe:
+			c.probe = v
+		case OptProbeTimeout:
+			c.probeTimeout, err = time.ParseDuration(v)
+		case OptCandidateTimeout:
+			c.candidateTimeout, err = time.ParseDuration(v)
+		case OptRequestTimeout:
+			c.requestTimeout, err = time.ParseDuration(v)
+		case OptCandidates:
+			c.candidates, err = strconv.Atoi(v)
+		case OptSweepInterval:
+			c.sweepInterval, err = time.ParseDuration(v)
+		case OptSweepRate:
+			c.sweepRate, err = strconv.Atoi(v)
+		case OptQuarantine:
+			c.quarantine, err = time.ParseDuration(v)
+		case OptAnnounce:
+			c.announce, err = strconv.ParseBool(v)
+		case OptForce:
+			c.force, err = parseRanges(v)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			log.WithError(err).WithField("option", k).WithField("value", v).Error("Invalid pool option")
+			return fmt.Errorf("Invalid pool option %v=%v: %v", k, v, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the numeric options of c are in range
+func (c *poolConfig) validate() error {
+	if c.excludeFirst < 0 || c.excludeLast < 0 || c.candidates < 0 || c.sweepInterval < 0 || c.sweepRate < 0 || c.quarantine < 0 {
+		return fmt.Errorf("Pool options must not be negative")
+	}
+	if c.probeTimeout <= 0 || c.candidateTimeout <= 0 || c.requestTimeout <= 0 {
+		return fmt.Errorf("Pool timeouts must be positive")
+	}
+	if c.sweepRate > maxSweepRate {
+		return fmt.Errorf("Sweep rate must be at most %v", maxSweepRate)
+	}
+	return nil
+}
+
+// defaultConfig returns the config pools start from
+func (d *Driver) defaultConfig() poolConfig {
+	d.cfgLock.RLock()
+	defer d.cfgLock.RUnlock()
+	return d.defaults
+}
+
+// getPool parses a pool ID and attaches its config
+func (d *Driver) getPool(id string) (*pool, error) {
+	p, err := parsePoolID(id)
+	if err != nil {
+		return nil, err
+	}
+	d.poolLock.Lock()
+	defer d.poolLock.Unlock()
+	if c, ok := d.pools[id]; ok {
+		p.cfg = c
+		return p, nil
+	}
+	if p.cfg, err = d.newPoolConfig(p, nil); err != nil {
+		return nil, err
+	}
+	d.pools[id] = p.cfg
+	return p, nil
+}
@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"testing"
+)
+
+func testConfig() poolConfig {
+	return poolConfig{
+		probeTimeout:     defaultProbeTimeout,
+		candidateTimeout: defaultCandidateTimeout,
+		requestTimeout:   defaultRequestTimeout,
+		candidates:       candidateSize,
+		sweepRate:        defaultSweepRate,
+	}
+}
+
+func TestPoolConfigValid(t *testing.T) {
+	c := testConfig()
+	err := c.apply(map[string]string{
+		OptProbeTimeout:     "1s",
+		OptCandidateTimeout: "2s",
+		OptRequestTimeout:   "3s",
+		OptSweepRate:        "100",
+		OptExcludeFirst:     "0",
+	})
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolConfigInvalid(t *testing.T) {
+	for _, opts := range []map[string]string{
+		{OptExcludeFirst: "-1"},
+		{OptCandidates: "-1"},
+		{OptQuarantine: "-1s"},
+		{OptProbeTimeout: "0s"},
+		{OptCandidateTimeout: "-1s"},
+		{OptRequestTimeout: "0s"},
+		{OptRequestTimeout: "-10s"},
+		{OptSweepRate: "2000000000"},
+		{OptForce: "10.0.0.1-"},
+		{optPrefix + "bogus": "1"},
+	} {
+		c := testConfig()
+		err := c.apply(opts)
+		if err == nil {
+			err = c.validate()
+		}
+		if err == nil {
+			t.Errorf("Options %v accepted", opts)
+		}
+	}
+}
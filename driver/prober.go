@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Probe methods
+const (
+	ProbeUDP  = "udp"
+	ProbeARP  = "arp"
+	ProbeICMP = "icmp"
+	ProbeDAD  = "dad"
+)
+
+// ProbeMethods lists the valid probe methods
+var ProbeMethods = []string{ProbeUDP, ProbeARP, ProbeICMP, ProbeDAD}
+
+// probeInterval is how often probes are resent while waiting for an answer
+const probeInterval = 1 * time.Second
+
+var errRecvTimeout = errors.New("receive timed out")
+
+// Prober determines whether an address is in use on the local network
+type Prober interface {
+	// Probe returns true if addr answered before the timeout. It gives up with
+	// the context's error if ctx is done first.
+	Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (reachable bool, err error)
+}
+
+// exceptProber is a Prober that can disregard answers from one MAC, so an
+// endpoint asking for its own address again doesn't find it in use
+type exceptProber interface {
+	ProbeExcept(ctx context.Context, addr *net.IPNet, to time.Duration, mac net.HardwareAddr) (reachable bool, err error)
+}
+
+// probeExcept probes addr with p, disregarding answers from mac if it isn't
+// nil. Probers that can't tell who answered fall back to the neighbor table,
+// which the kernel fills while resolving the address for udp and icmp probes.
+func probeExcept(ctx context.Context, p Prober, addr *net.IPNet, to time.Duration, mac net.HardwareAddr) (bool, error) {
+	if mac == nil {
+		return p.Probe(ctx, addr, to)
+	}
+	if ep, ok := p.(exceptProber); ok {
+		return ep.ProbeExcept(ctx, addr, to, mac)
+	}
+	r, err := p.Probe(ctx, addr, to)
+	if r && err == nil && ownedBy(addr.IP, mac) {
+		log.WithField("ip", addr.IP).WithField("mac", mac).Debug("Address in use by requesting MAC")
+		r = false
+	}
+	return r, err
+}
+
+func (d *Driver) newProber(method string) (Prober, error) {
+	udp := &udpProber{ns: d.ns}
+	var p Prober
+	switch method {
+	case ProbeUDP, "":
+		method = ProbeUDP
+		p = udp
+	case ProbeARP:
+		p = &arpProber{listeners: d.arpListeners, v6: udp}
+	case ProbeICMP:
+		p = &icmpProber{}
+	case ProbeDAD:
+		p = &dadProber{listeners: d.arpListeners, v6: udp}
+	default:
+		return nil, fmt.Errorf("Unknown probe method: %v", method)
+	}
+	return &instrumentedProber{method: method, Prober: p}, nil
+}
+
+// udpProber kicks the kernel into resolving the address by sending it a udp
+// packet, then waits on the neighbor table for the result
+type udpProber struct {
+	ns *neighSubscription
+}
+
+func (p *udpProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	return p.ns.probeAndWait(ctx, addr, to)
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
+
+// recvDeadline reads from a raw socket, giving up at deadline
+func recvDeadline(fd int, buf []byte, deadline time.Time) (int, syscall.Sockaddr, error) {
+	d := deadline.Sub(time.Now())
+	if d <= 0 {
+		return 0, nil, errRecvTimeout
+	}
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return 0, nil, err
+	}
+	n, from, err := syscall.Recvfrom(fd, buf, 0)
+	if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+		return 0, nil, errRecvTimeout
+	}
+	return n, from, err
+}
+
+// nextWait returns the earlier of the next send time and the stop time
+func nextWait(nextSend, stop time.Time) time.Time {
+	if nextSend.Before(stop) {
+		return nextSend
+	}
+	return stop
+}
@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeProber finds every address in use by owner
+type fakeProber struct {
+	owner net.HardwareAddr
+}
+
+func (p *fakeProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (p *fakeProber) ProbeExcept(ctx context.Context, addr *net.IPNet, to time.Duration, mac net.HardwareAddr) (bool, error) {
+	return !bytes.Equal(mac, p.owner), nil
+}
+
+func TestProbeExceptInstrumented(t *testing.T) {
+	owner, _ := net.ParseMAC("02:00:00:00:00:01")
+	other, _ := net.ParseMAC("02:00:00:00:00:02")
+	p := &instrumentedProber{method: "fake", Prober: &fakeProber{owner: owner}}
+	addr := &net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)}
+	for _, c := range []struct {
+		mac  net.HardwareAddr
+		want bool
+	}{
+		{nil, true},
+		{owner, false},
+		{other, true},
+	} {
+		r, err := probeExcept(context.Background(), p, addr, time.Second, c.mac)
+		if err != nil || r != c.want {
+			t.Errorf("Probe except %v: reachable %v, err %v, want %v", c.mac, r, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/TrilliumIT/iputil"
+	"github.com/vishvananda/netlink"
+)
+
+// ipRange is an inclusive range of addresses
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// parseRange parses a single address, a range as <start>-<end>, or a cidr
+func parseRange(s string) (*ipRange, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		n, err := netlink.ParseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		n.IP = n.IP.Mask(n.Mask)
+		return &ipRange{start: iputil.FirstAddr(n).To16(), end: iputil.LastAddr(n).To16()}, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	start := net.ParseIP(strings.TrimSpace(parts[0]))
+	if start == nil {
+		return nil, fmt.Errorf("Unable to parse address: %v", parts[0])
+	}
+	end := start
+	if len(parts) == 2 {
+		end = net.ParseIP(strings.TrimSpace(parts[1]))
+		if end == nil {
+			return nil, fmt.Errorf("Unable to parse address: %v", parts[1])
+		}
+	}
+	if (start.To4() == nil) != (end.To4() == nil) || bytes.Compare(start.To16(), end.To16()) > 0 {
+		return nil, fmt.Errorf("Invalid range: %v", s)
+	}
+	return &ipRange{start: start.To16(), end: end.To16()}, nil
+}
+
+func (r *ipRange) contains(ip net.IP) bool {
+	ip = ip.To16()
+	return bytes.Compare(ip, r.start) >= 0 && bytes.Compare(ip, r.end) <= 0
+}
+
+func (r *ipRange) String() string {
+	if r.start.Equal(r.end) {
+		return r.start.String()
+	}
+	return r.start.String() + "-" + r.end.String()
+}
+
+// ipRanges is a set of addresses made up of ranges
+type ipRanges []*ipRange
+
+// parseRanges parses a comma separated list of ranges
+func parseRanges(s string) (ipRanges, error) {
+	var rs ipRanges
+	for _, f := range strings.Split(s, ",") {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		r, err := parseRange(f)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func (rs ipRanges) contains(ip net.IP) bool {
+	for _, r := range rs {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs ipRanges) strings() []string {
+	var s []string
+	for _, r := range rs {
+		s = append(s, r.String())
+	}
+	return s
+}
+
+// readRangesFile reads ranges from a file with one range per line. Blank lines
+// and lines starting with # are ignored.
+func readRangesFile(path string) (ipRanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.WithError(err).WithField("file", path).Error("Error opening reservations file")
+		return nil, err
+	}
+	defer f.Close()
+
+	var rs ipRanges
+	s := bufio.NewScanner(f)
+	for l := 1; s.Scan(); l++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRange(line)
+		if err != nil {
+			log.WithError(err).WithField("file", path).WithField("line", l).Error("Error parsing reservation")
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, s.Err()
+}
+
+// isReserved returns true if ip is reserved globally or in p
+func (d *Driver) isReserved(p *pool, ip net.IP) bool {
+	return d.globalReserved(ip) || p.cfg.reserved.contains(ip)
+}
+
+// excluded returns true if the config of p keeps ip from being given out
+// randomly
+func (d *Driver) excluded(p *pool, ip net.IP) bool {
+	return p.cfg.exclude.contains(ip) || d.isReserved(p, ip)
+}
+
+// globalReserved returns true if ip is reserved in every pool
+func (d *Driver) globalReserved(ip net.IP) bool {
+	d.cfgLock.RLock()
+	defer d.cfgLock.RUnlock()
+	return d.reserved.contains(ip)
+}
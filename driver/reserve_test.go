@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"10.0.0.1", []string{"10.0.0.1"}},
+		{" 10.0.0.1 , 10.0.0.5-10.0.0.9 ", []string{"10.0.0.1", "10.0.0.5-10.0.0.9"}},
+		{"10.0.0.5-10.0.0.5", []string{"10.0.0.5"}},
+		{"10.0.0.0/30", []string{"10.0.0.0-10.0.0.3"}},
+		{"10.0.0.7/30", []string{"10.0.0.4-10.0.0.7"}},
+		{"fd00::1-fd00::ff,10.0.0.1", []string{"fd00::1-fd00::ff", "10.0.0.1"}},
+		{"fd00::/126", []string{"fd00::-fd00::3"}},
+		{"10.0.0.1,,", []string{"10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		rs, err := parseRanges(tt.in)
+		if err != nil {
+			t.Errorf("parseRanges(%q): %v", tt.in, err)
+			continue
+		}
+		got := rs.strings()
+		if len(got) != len(tt.want) {
+			t.Errorf("parseRanges(%q) = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseRanges(%q) = %v, want %v", tt.in, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseRangesInvalid(t *testing.T) {
+	for _, s := range []string{
+		"10.0.0.9-10.0.0.5", // reversed
+		"fd00::ff-fd00::1",  // reversed
+		"10.0.0.1-fd00::1",  // mixed families
+		"fd00::1-10.0.0.1",  // mixed families
+		"10.0.0.1-",
+		"10.0.0.256",
+		"10.0.0.1,bogus",
+		"10.0.0.0/33",
+	} {
+		if rs, err := parseRanges(s); err == nil {
+			t.Errorf("parseRanges(%q) = %v, want an error", s, rs.strings())
+		}
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	rs, err := parseRanges("10.0.0.5-10.0.0.9,fd00::10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.4", false},
+		{"10.0.0.5", true},
+		{"10.0.0.9", true},
+		{"10.0.0.10", false},
+		{"fd00::10", true},
+		{"fd00::11", false},
+		{"::ffff:10.0.0.6", true}, // v4 in v6 form is the same address
+	}
+	for _, tt := range tests {
+		if got := rs.contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("contains(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
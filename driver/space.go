@@ -0,0 +1,96 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultAddressSpace is the local address space used unless others are
+// configured
+const DefaultAddressSpace = "arp-ipam-default"
+
+// GlobalAddressSpace is the global address space used unless others are
+// configured. Only pools in the global space are leased from a coordinator.
+const GlobalAddressSpace = "arp-ipam-global"
+
+// spacesConfig is the address spaces file
+//
+//	local-default: lab
+//	global-default: arp-ipam-global
+//	spaces:
+//	  lab:
+//	    arp-ipam.probe: arp
+//	    arp-ipam.exclude-first: 10
+type spacesConfig struct {
+	LocalDefault  string                       `yaml:"local-default"`
+	GlobalDefault string                       `yaml:"global-default"`
+	Spaces        map[string]map[string]string `yaml:"spaces"`
+}
+
+// loadSpaces reads the address spaces file at path into the driver. The
+// default local and global address spaces always exist, with no options unless
+// configured.
+func (d *Driver) loadSpaces(path string) error {
+	d.spaces = map[string]map[string]string{DefaultAddressSpace: nil, GlobalAddressSpace: nil}
+	d.localSpace = DefaultAddressSpace
+	d.globalSpace = GlobalAddressSpace
+	if path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.WithError(err).WithField("file", path).Error("Error reading address spaces")
+		return err
+	}
+	var sc spacesConfig
+	if err := yaml.Unmarshal(b, &sc); err != nil {
+		log.WithError(err).WithField("file", path).Error("Error parsing address spaces")
+		return err
+	}
+	for name, opts := range sc.Spaces {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("Invalid address space name: %q", name)
+		}
+		c := d.defaultConfig()
+		if err := c.apply(opts); err != nil {
+			return fmt.Errorf("Address space %v: %v", name, err)
+		}
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("Address space %v: %v", name, err)
+		}
+		if _, err := d.newProber(c.probe); err != nil {
+			return fmt.Errorf("Address space %v: %v", name, err)
+		}
+		d.spaces[name] = opts
+	}
+	if sc.LocalDefault != "" {
+		d.localSpace = sc.LocalDefault
+	}
+	if sc.GlobalDefault != "" {
+		d.globalSpace = sc.GlobalDefault
+	}
+	for _, s := range []string{d.localSpace, d.globalSpace} {
+		if _, ok := d.spaces[s]; !ok {
+			return fmt.Errorf("Unknown default address space: %v", s)
+		}
+	}
+	log.WithField("spaces", len(d.spaces)).Debug("Loaded address spaces")
+	return nil
+}
+
+// addressSpace returns the configured address space called name, or the local
+// default if name is empty
+func (d *Driver) addressSpace(name string) (string, error) {
+	if name == "" {
+		return d.localSpace, nil
+	}
+	if _, ok := d.spaces[name]; !ok {
+		return "", fmt.Errorf("Unknown address space: %v", name)
+	}
+	return name, nil
+}
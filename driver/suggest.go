@@ -1,13 +1,13 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/TrilliumIT/iputil"
 	"github.com/vishvananda/netlink"
 )
 
@@ -18,47 +18,160 @@ type candidateNets struct {
 }
 
 type candidateList struct {
-	candidates [candidateSize]*subscription
-	quit       <-chan struct{}
+	candidates []*subscription
+	quit       <-chan struct{} // closed on driver quit or when the pool is released
+	ctx        context.Context // cancelled along with quit, for background probes
+	stop       chan struct{}
 	popCh      chan chan *net.IPNet
 	addCh      chan *net.IPNet
 	delCh      chan *net.IPNet
+	listCh     chan chan []*net.IPNet
+	reloadCh   chan struct{}
+	lock       sync.Mutex // protects p, occ and sweeping
+	p          *pool
+	occ        *occupancy // set once the pool has been swept
+	sweeping   bool
 }
 
 // Does nothing if net already exists
-func (cn *candidateNets) addNet(n *net.IPNet, ns *neighSubscription, xf, xl int) *candidateList {
+func (cn *candidateNets) addNet(p *pool, d *Driver) *candidateList {
 	cn.lock.Lock()
 	defer cn.lock.Unlock()
-	if cl, ok := cn.nets[n.String()]; ok {
+	if cl, ok := cn.nets[p.id()]; ok {
 		return cl
 	}
+	quit := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
 	cl := &candidateList{
-		quit:  cn.quit,
-		popCh: make(chan chan *net.IPNet),
-		addCh: make(chan *net.IPNet),
-		delCh: make(chan *net.IPNet),
+		candidates: make([]*subscription, p.cfg.candidates),
+		quit:       quit,
+		ctx:        ctx,
+		stop:       make(chan struct{}),
+		popCh:      make(chan chan *net.IPNet),
+		addCh:      make(chan *net.IPNet),
+		delCh:      make(chan *net.IPNet),
+		listCh:     make(chan chan []*net.IPNet),
+		reloadCh:   make(chan struct{}, 1),
+		p:          p,
 	}
-	go cl.fill(n, ns, xf, xl)
-	cn.nets[n.String()] = cl
+	go func() {
+		select {
+		case <-cn.quit:
+		case <-cl.stop:
+		}
+		close(quit)
+		cancel()
+	}()
+	cl.lock.Lock()
+	cl.startSweep(p)
+	cl.lock.Unlock()
+	go cl.fill(p, d)
+	cn.nets[p.id()] = cl
 	return cl
 }
 
-func (cl *candidateList) pop(ns *neighSubscription) *net.IPNet {
-	pc := make(chan *net.IPNet)
-	defer close(pc)
-	cl.popCh <- pc
-	return <-pc
+// remove stops filling and sweeping a released pool and drops its candidates
+func (cn *candidateNets) remove(id string) {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	if cl, ok := cn.nets[id]; ok {
+		close(cl.stop)
+		delete(cn.nets, id)
+	}
+}
+
+// occupancy returns the occupancy map of a swept pool, or nil
+func (cn *candidateNets) occupancy(id string) *occupancy {
+	cl := cn.get(id)
+	if cl == nil {
+		return nil
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.occ
+}
+
+// get returns the candidate list for a pool, or nil if there is none
+func (cn *candidateNets) get(id string) *candidateList {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	return cn.nets[id]
+}
+
+// pool returns the pool with its current config
+func (cl *candidateList) pool() *pool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.p
+}
+
+// setPool replaces the config of the pool. Candidates are probed again with the
+// new config, and the list is resized to the new number of candidates.
+func (cl *candidateList) setPool(p *pool) {
+	cl.lock.Lock()
+	cl.p = p
+	cl.startSweep(p)
+	cl.lock.Unlock()
+	select {
+	case cl.reloadCh <- struct{}{}:
+	default:
+	}
 }
 
-func (cl *candidateList) fill(n *net.IPNet, ns *neighSubscription, xf, xl int) {
+// list returns the addresses currently held as candidates
+func (cl *candidateList) list() []*net.IPNet {
+	lc := make(chan []*net.IPNet)
+	select {
+	case cl.listCh <- lc:
+		return <-lc
+	case <-cl.quit:
+		return nil
+	}
+}
+
+// pop takes the next candidate, or nil if there are none. pc is buffered so
+// the fill loop never blocks on a pop abandoned when ctx is done.
+func (cl *candidateList) pop(ctx context.Context) *net.IPNet {
+	pc := make(chan *net.IPNet, 1)
+	select {
+	case cl.popCh <- pc:
+	case <-ctx.Done():
+		return nil
+	case <-cl.quit:
+		return nil
+	}
+	select {
+	case r := <-pc:
+		return r
+	case <-ctx.Done():
+	}
+	// The fill loop always answers a pop it has taken, and has already removed
+	// the candidate from the list. Put it back rather than losing it.
+	if r := <-pc; r != nil {
+		select {
+		case cl.addCh <- r:
+		case <-cl.quit:
+		}
+	}
+	return nil
+}
+
+func (cl *candidateList) fill(p *pool, d *Driver) {
+	ns := d.ns
 	t := time.NewTicker(3 * time.Second)
 	defer t.Stop()
 	uch := make(chan *netlink.Neigh)
-	defer close(uch)
+	defer func() {
+		for _, s := range cl.candidates {
+			if s != nil {
+				s.delSub()
+			}
+		}
+	}()
 
 	for _, s := range cl.candidates {
 		if s == nil {
-			go sendRandomUnusedAddress(n, ns, xf, xl, cl.addCh)
+			go d.sendRandomUnusedAddress(p, cl)
 		}
 	}
 
@@ -68,26 +181,50 @@ mainLoop:
 		case pc := <-cl.popCh: // pop a suggested address
 			for i, s := range cl.candidates {
 				if s == nil {
-					go sendRandomUnusedAddress(n, ns, xf, xl, cl.addCh)
+					go d.sendRandomUnusedAddress(p, cl)
+					continue
+				}
+				if d.leases.held(p.id(), s.ip.IP) {
+					log.WithField("ip", s.ip).Debug("Dropping leased address from suggestions")
+					s.delSub()
+					cl.candidates[i] = nil
+					go d.sendRandomUnusedAddress(p, cl)
 					continue
 				}
 				log.WithField("ip", s.ip).Debug("Popping address from suggestions")
 				pc <- s.ip
 				s.delSub()
 				cl.candidates[i] = nil
-				go sendRandomUnusedAddress(n, ns, xf, xl, cl.addCh)
+				go d.sendRandomUnusedAddress(p, cl)
 				continue mainLoop
 			}
 			pc <- nil
 			continue mainLoop
+		case lc := <-cl.listCh:
+			var l []*net.IPNet
+			for _, s := range cl.candidates {
+				if s != nil {
+					l = append(l, s.ip)
+				}
+			}
+			lc <- l
+			continue mainLoop
 		case ip := <-cl.addCh:
 			for i, s := range cl.candidates {
 				if s == nil {
-					s := ns.addSub(ip)
+					s, err := ns.addSub(ip)
+					if err != nil {
+						continue mainLoop
+					}
 					cl.candidates[i] = s
+					// Read until the subscription is closed, once the
+					// list has stopped updates are dropped
 					go func(s *subscription) {
 						for u := range s.sub {
-							uch <- u
+							select {
+							case uch <- u:
+							case <-cl.quit:
+							}
 						}
 					}(s)
 					continue mainLoop
@@ -97,16 +234,38 @@ mainLoop:
 		case ip := <-cl.delCh:
 			for i, s := range cl.candidates {
 				if s == nil {
-					go sendRandomUnusedAddress(n, ns, xf, xl, cl.addCh)
+					go d.sendRandomUnusedAddress(p, cl)
 					continue
 				}
 				if s.ip.IP.Equal(ip.IP) {
 					s.delSub()
 					cl.candidates[i] = nil
-					go sendRandomUnusedAddress(n, ns, xf, xl, cl.addCh)
+					go d.sendRandomUnusedAddress(p, cl)
 				}
 			}
 			continue mainLoop
+		case <-cl.reloadCh: // the pool config changed
+			p = cl.pool()
+			w, err := newAddrWalker(p)
+			if err != nil {
+				log.WithError(err).WithField("pool", p.id()).Error("Error checking candidates against the new config")
+			}
+			for i, s := range cl.candidates {
+				if s != nil && (w != nil && !w.contains(s.ip.IP) || d.excluded(p, s.ip.IP)) {
+					log.WithField("ip", s.ip).Debug("Dropping candidate excluded by the new config")
+					s.delSub()
+					cl.candidates[i] = nil
+				}
+			}
+			for len(cl.candidates) > p.cfg.candidates {
+				if s := cl.candidates[len(cl.candidates)-1]; s != nil {
+					s.delSub()
+				}
+				cl.candidates = cl.candidates[:len(cl.candidates)-1]
+			}
+			for len(cl.candidates) < p.cfg.candidates {
+				cl.candidates = append(cl.candidates, nil)
+			}
 		case <-cl.quit:
 			return
 		case <-uch: // We got an update from the arp table
@@ -115,89 +274,169 @@ mainLoop:
 
 		for _, s := range cl.candidates {
 			if s == nil {
-				go sendRandomUnusedAddress(n, ns, xf, xl, cl.addCh)
+				go d.sendRandomUnusedAddress(p, cl)
 				continue
 			}
-			go func(s *subscription) {
-				r, err := ns.probeAndWait(s.ip, 15*time.Second)
+			go func(s *subscription, p *pool) {
+				r, err := p.cfg.prober.Probe(cl.ctx, s.ip, p.cfg.candidateTimeout)
+				if err == errShuttingDown || cl.ctx.Err() != nil {
+					return
+				}
 				if err != nil {
 					if _, ok := err.(*probeTimeoutError); ok {
 						log.WithError(err).Debug("Timed out probing candidate ip. Trying another")
 					} else {
 						log.WithError(err).WithField("ip", s.ip.String()).Error("Error probing candidate IP")
 					}
-					cl.delCh <- s.ip
+					cl.del(s.ip)
 					return
 				}
 				if r {
 					log.WithField("ip", s).Debug("Candidate IP in use")
-					cl.delCh <- s.ip
+					cl.del(s.ip)
 				}
-			}(s)
+			}(s, p)
 		}
 	}
 }
 
-func sendRandomUnusedAddress(n *net.IPNet, ns *neighSubscription, xf, xl int, c chan<- *net.IPNet) {
-	addr, err := getNewRandomUnusedAddr(n, 15*time.Second, ns, xf, xl)
+// del drops ip from the candidates
+func (cl *candidateList) del(ip *net.IPNet) {
+	select {
+	case cl.delCh <- ip:
+	case <-cl.quit:
+	}
+}
+
+func (d *Driver) sendRandomUnusedAddress(p *pool, cl *candidateList) {
+	addr, err := d.getNewRandomUnusedAddr(cl.ctx, p, p.cfg.candidateTimeout)
 	if err != nil {
-		log.WithError(err).Error("Error getting new random address.")
+		if cl.ctx.Err() == nil {
+			log.WithError(err).Error("Error getting new random address.")
+		}
 		return
 	}
-	c <- addr
+	select {
+	case cl.addCh <- addr:
+	case <-cl.quit:
+	}
 }
 
-func (d *Driver) getRandomUnusedAddr(n *net.IPNet, to time.Duration) (*net.IPNet, error) {
-	cl := d.candidates.addNet(n, d.ns, d.xf, d.xl)
-	r := cl.pop(d.ns)
-	if r != nil {
+func (d *Driver) getRandomUnusedAddr(ctx context.Context, p *pool) (*net.IPNet, error) {
+	cl := d.candidates.addNet(p, d)
+	r := cl.pop(ctx)
+	// The candidate may have been queued under an older config
+	if r != nil && !d.excluded(p, r.IP) && d.ledger.get(p.id(), r.IP) == nil && !d.ledger.quarantined(p.id(), r.IP) && d.leases.take(p.id(), r.IP, p.cfg.requestTimeout) {
+		candidatePops.WithLabelValues("hit").Inc()
 		return r, nil
 	}
-	r, err := getNewRandomUnusedAddr(n, to, d.ns, d.xf, d.xl)
-	if err != nil {
-		log.WithError(err).Error("Error getting new random address")
-		return nil, err
+	candidatePops.WithLabelValues("miss").Inc()
+	for i := 1; ; i++ {
+		r, err := d.getNewRandomUnusedAddr(ctx, p, p.cfg.probeTimeout)
+		if err != nil {
+			log.WithError(err).Error("Error getting new random address")
+			return nil, err
+		}
+		if d.leases.take(p.id(), r.IP, p.cfg.requestTimeout) {
+			return r, nil
+		}
+		if i >= leaseAttempts {
+			return nil, fmt.Errorf("Address %v is being allocated", r.IP)
+		}
+		log.WithField("ip", r.IP).Debug("Random address leased by another request, retrying")
 	}
-	return r, nil
 }
 
-func getNewRandomUnusedAddr(n *net.IPNet, to time.Duration, ns *neighSubscription, xf, xl int) (*net.IPNet, error) {
-	log.Debugf("Generating Random Address in network %v", n)
-	tried := make(map[string]struct{})
-	var e struct{}
-	ones, maskSize := n.Mask.Size()
-	totalAddresses := 1 << uint8(maskSize-ones)
-	if totalAddresses > 2 { // This network is not a /30 exclude first and last
-		tried[iputil.FirstAddr(n).String()] = e
-		tried[iputil.LastAddr(n).String()] = e
-	}
-	// Add excluded addresses to tried array
-	for i := 1; i <= xf; i++ {
-		tried[iputil.IPAdd(iputil.FirstAddr(n), i).String()] = e
+func (d *Driver) getNewRandomUnusedAddr(ctx context.Context, p *pool, to time.Duration) (*net.IPNet, error) {
+	n := p.IPNet
+	log.Debugf("Generating Random Address in network %v from %v", n, p.randRange())
+	w, err := newAddrWalker(p)
+	if err != nil {
+		return nil, err
 	}
-	for i := 1; i <= xl; i++ {
-		tried[iputil.IPAdd(iputil.LastAddr(n), i*-1).String()] = e
+	if o := d.candidates.occupancy(p.id()); o != nil {
+		ip := o.pick(n.IP.To4() != nil, func(ip net.IP) bool {
+			return !w.contains(ip) || d.excluded(p, ip) || d.ledger.get(p.id(), ip) != nil || d.ledger.quarantined(p.id(), ip) || d.leases.held(p.id(), ip)
+		})
+		if ip != nil {
+			// The sweep may be a whole interval old, check the address is still free
+			addr := &net.IPNet{IP: ip, Mask: n.Mask}
+			r, err := p.cfg.prober.Probe(ctx, addr, to)
+			if err == errShuttingDown {
+				return nil, err
+			}
+			// The probe may have answered after ctx was done
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err == nil && !r {
+				log.WithField("IP", ip).Debug("Returning longest silent address from sweep")
+				return addr, nil
+			}
+			o.set(ip, true)
+			log.WithError(err).WithField("ip", ip).Debug("Longest silent address from sweep not free, walking the pool")
+		}
 	}
-	for len(tried) < totalAddresses {
-		ip := iputil.RandAddr(n)
-		if _, ok := tried[ip.String()]; ok { // this address was already tried
+	return d.nextUnusedAddr(ctx, p, w, to)
+}
+
+// nextUnusedAddr returns the next address from w which is not excluded,
+// reserved, allocated or in use
+func (d *Driver) nextUnusedAddr(ctx context.Context, p *pool, w *addrWalker, to time.Duration) (*net.IPNet, error) {
+	n := p.IPNet
+	var probed, inUse float64
+	defer func() {
+		if probed == 0 {
+			return
+		}
+		ratio := inUse / probed
+		poolInUseRatio.WithLabelValues(p.id()).Set(ratio)
+		poolFreeEstimate.WithLabelValues(p.id()).Set(w.size() * (1 - ratio))
+	}()
+	for {
+		ip, ok := w.next()
+		if !ok {
+			break
+		}
+		if d.excluded(p, ip) {
+			continue
+		}
+		if d.ledger.get(p.id(), ip) != nil {
+			log.WithField("ip", ip).Debug("Random address already allocated, retrying")
+			continue
+		}
+		if d.ledger.quarantined(p.id(), ip) {
+			log.WithField("ip", ip).Debug("Random address recently released, retrying")
+			continue
+		}
+		if d.leases.held(p.id(), ip) {
+			log.WithField("ip", ip).Debug("Random address leased, retrying")
 			continue
 		}
 		addr := &net.IPNet{
 			IP:   ip,
 			Mask: n.Mask,
 		}
-		r, err := ns.probeAndWait(addr, to)
+		r, err := p.cfg.prober.Probe(ctx, addr, to)
+		if err == errShuttingDown {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if err != nil {
 			log.WithError(err).Error("Error probing random address")
 			continue
 		}
+		probed++
+		if r {
+			inUse++
+		}
 		if !r {
 			log.WithField("IP", ip).Debug("Returning Random Address")
 			return &net.IPNet{IP: ip, Mask: n.Mask}, nil
 		}
 		log.WithField("ip", ip).Debug("Random address reachable, retrying")
-		tried[ip.String()] = e
 	}
 	return nil, fmt.Errorf("All avaliable addresses are in use")
 }
@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPopCancelledKeepsCandidate(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	cl := &candidateList{
+		quit:  quit,
+		popCh: make(chan chan *net.IPNet),
+		addCh: make(chan *net.IPNet),
+	}
+	ip := &net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Answer the pop only after the request has given up on it
+	go func() {
+		pc := <-cl.popCh
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		pc <- ip
+	}()
+	res := make(chan *net.IPNet)
+	go func() { res <- cl.pop(ctx) }()
+
+	select {
+	case r := <-cl.addCh:
+		if !r.IP.Equal(ip.IP) {
+			t.Errorf("Returned %v to the list, want %v", r, ip)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Candidate taken by a cancelled pop was not returned to the list")
+	}
+	if r := <-res; r != nil {
+		t.Errorf("Cancelled pop returned %v", r)
+	}
+}
+
+// freeProber finds every address free
+type freeProber struct{}
+
+func (freeProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	return false, ctx.Err()
+}
+
+// cancelProber cancels the request, then finds the address free
+type cancelProber struct {
+	cancel context.CancelFunc
+}
+
+func (p *cancelProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	p.cancel()
+	return false, nil
+}
+
+// usedProber finds every address in use, answering only once ctx is done
+type usedProber struct{}
+
+func (usedProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	<-ctx.Done()
+	return true, ctx.Err()
+}
+
+// testCandidates returns a driver with a candidate list for a pool of id with
+// config c, whose fill loop isn't running
+func testCandidates(t *testing.T, quit chan struct{}, id string, c poolConfig) (*Driver, *pool, *candidateList) {
+	l, err := newLedger("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Driver{
+		ledger:     l,
+		leases:     newLocalLeases(),
+		candidates: &candidateNets{nets: make(map[string]*candidateList), quit: quit},
+	}
+	p, err := parsePoolID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cfg = &c
+	cl := &candidateList{quit: quit, popCh: make(chan chan *net.IPNet), p: p}
+	d.candidates.nets[p.id()] = cl
+	return d, p, cl
+}
+
+func TestPopReservedCandidate(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	c := testConfig()
+	c.prober = freeProber{}
+	// Reserved after the candidate was queued, as a reload would
+	var err error
+	if c.reserved, err = parseRanges("10.0.0.1-10.0.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	d, p, cl := testCandidates(t, quit, "10.0.0.0/29", c)
+	go func() {
+		pc := <-cl.popCh
+		pc <- &net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: p.Mask}
+	}()
+
+	r, err := d.getRandomUnusedAddr(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.isReserved(p, r.IP) {
+		t.Errorf("Reserved candidate %v handed out", r)
+	}
+}
+
+func TestRandomAddrCancelledAfterProbe(t *testing.T) {
+	for _, swept := range []bool{false, true} {
+		quit := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		c := testConfig()
+		c.prober = &cancelProber{cancel: cancel}
+		d, p, cl := testCandidates(t, quit, "10.0.0.0/29", c)
+		if swept {
+			o, err := newOccupancy(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o.swept = true
+			cl.occ = o
+		}
+
+		r, err := d.getNewRandomUnusedAddr(ctx, p, time.Second)
+		if r != nil || err != context.Canceled {
+			t.Errorf("Swept %v: got %v, %v after the request was cancelled, want %v", swept, r, err, context.Canceled)
+		}
+		close(quit)
+	}
+}
+
+func TestBackgroundWalkStopsOnRelease(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	c := testConfig()
+	c.prober = usedProber{}
+	d, p, cl := testCandidates(t, quit, "10.0.0.0/24", c)
+	ctx, cancel := context.WithCancel(context.Background())
+	cl.ctx = ctx
+
+	done := make(chan struct{})
+	go func() {
+		d.sendRandomUnusedAddress(p, cl)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// Releasing the pool cancels the list's context
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Walk for a candidate still probing after the pool was released")
+	}
+}
@@ -0,0 +1,237 @@
+package driver
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Pools with more addresses than this are never swept
+const maxSweepBits = 16
+
+const defaultSweepRate = 10
+
+// maxSweepRate is the most addresses probed per second while sweeping. The
+// probes are paced by a ticker, which needs a non-zero interval.
+const maxSweepRate = 10000
+
+// maxNeighSweepRate is the most addresses probed per second while sweeping with
+// a prober that waits on the kernel neighbor table. Each probe leaves an entry
+// there until it is garbage collected, too many fill the table for the whole
+// host.
+const maxNeighSweepRate = 10
+
+// maxSweepProbes is the most probes a sweep has running at once
+const maxSweepProbes = 32
+
+// occupancy is the state of every address in a pool as seen by the sweeper
+type occupancy struct {
+	lock   sync.Mutex
+	base   *big.Int
+	used   []uint64    // bitmap of addresses in use when last probed
+	probed []time.Time // when each address was last probed
+	seen   []time.Time // when each address was last seen in use
+	swept  bool        // true once every address has been probed
+}
+
+// newOccupancy returns an empty occupancy map covering the addresses which
+// may be given out randomly from p
+func newOccupancy(p *pool) (*occupancy, error) {
+	w, err := newAddrWalker(p)
+	if err != nil {
+		return nil, err
+	}
+	if w.size() > 1<<maxSweepBits {
+		return nil, fmt.Errorf("Pool %v is too large to sweep", p.id())
+	}
+	size := int(w.size())
+	return &occupancy{
+		base:   w.base,
+		used:   make([]uint64, (size+63)/64),
+		probed: make([]time.Time, size),
+		seen:   make([]time.Time, size),
+	}, nil
+}
+
+func (o *occupancy) index(ip net.IP) (int, bool) {
+	i := new(big.Int).Sub(ipToInt(ip), o.base)
+	if i.Sign() < 0 || i.Cmp(big.NewInt(int64(len(o.probed)))) >= 0 {
+		return 0, false
+	}
+	return int(i.Int64()), true
+}
+
+// set records the result of probing ip
+func (o *occupancy) set(ip net.IP, inUse bool) {
+	i, ok := o.index(ip)
+	if !ok {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.probed[i] = time.Now()
+	if inUse {
+		o.used[i/64] |= 1 << uint(i%64)
+		o.seen[i] = o.probed[i]
+		return
+	}
+	o.used[i/64] &^= 1 << uint(i%64)
+}
+
+// pick returns the free address which has been silent longest, skipping any for
+// which skip returns true. The address is marked in use until it is next probed.
+// Nothing is returned until the pool has been swept once.
+func (o *occupancy) pick(v4 bool, skip func(net.IP) bool) net.IP {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.swept {
+		return nil
+	}
+	// start at a random offset so ties, such as addresses never seen, are broken randomly
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(len(o.probed))))
+	if err != nil {
+		return nil
+	}
+	start := int(r.Int64())
+	best := -1
+	for j := range o.probed {
+		i := (start + j) % len(o.probed)
+		if o.used[i/64]&(1<<uint(i%64)) != 0 {
+			continue
+		}
+		if best >= 0 && !o.seen[i].Before(o.seen[best]) {
+			continue
+		}
+		if skip(o.ip(i, v4)) {
+			continue
+		}
+		best = i
+	}
+	if best < 0 {
+		return nil
+	}
+	o.used[best/64] |= 1 << uint(best%64)
+	o.seen[best] = time.Now()
+	return o.ip(best, v4)
+}
+
+func (o *occupancy) ip(i int, v4 bool) net.IP {
+	return intToIP(new(big.Int).Add(o.base, big.NewInt(int64(i))), v4)
+}
+
+// startSweep starts sweeping p if it is configured to be swept and is not
+// already. The caller must hold cl.lock.
+func (cl *candidateList) startSweep(p *pool) {
+	if p.cfg.sweepInterval <= 0 || cl.sweeping {
+		return
+	}
+	if cl.occ == nil {
+		o, err := newOccupancy(p)
+		if err != nil {
+			log.WithError(err).WithField("pool", p.id()).Warn("Not sweeping pool")
+			return
+		}
+		cl.occ = o
+	}
+	cl.sweeping = true
+	go cl.sweep(cl.occ)
+}
+
+// sweep probes every address in the pool at its sweep rate, then waits its
+// sweep interval and starts again. The pool config is read at the start of
+// each sweep, sweeping stops if it is no longer configured.
+func (cl *candidateList) sweep(o *occupancy) {
+	for {
+		cl.lock.Lock()
+		p := cl.p
+		if p.cfg.sweepInterval <= 0 {
+			cl.sweeping = false
+			cl.lock.Unlock()
+			o.lock.Lock()
+			o.swept = false
+			o.lock.Unlock()
+			return
+		}
+		cl.lock.Unlock()
+		rate := p.cfg.sweepRate
+		if rate <= 0 {
+			rate = defaultSweepRate
+		}
+		if usesNeighTable(p) && rate > maxNeighSweepRate {
+			log.WithField("pool", p.id()).WithField("rate", rate).WithField("probe", p.cfg.probe).
+				Warnf("Sweeping at %v addresses per second, the most for a probe method using the neighbor table", maxNeighSweepRate)
+			rate = maxNeighSweepRate
+		}
+		st := time.Now()
+		w, err := newAddrWalker(p)
+		if err != nil {
+			log.WithError(err).WithField("pool", p.id()).Error("Error starting sweep")
+			cl.lock.Lock()
+			cl.sweeping = false
+			cl.lock.Unlock()
+			o.lock.Lock()
+			o.swept = false
+			o.lock.Unlock()
+			return
+		}
+		lim := time.NewTicker(time.Second / time.Duration(rate))
+		wg := sync.WaitGroup{}
+		sem := make(chan struct{}, maxSweepProbes)
+		for ip, ok := w.next(); ok; ip, ok = w.next() {
+			select {
+			case <-lim.C:
+			case <-cl.quit:
+				lim.Stop()
+				return
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-cl.quit:
+				lim.Stop()
+				return
+			}
+			wg.Add(1)
+			go func(ip net.IP) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				r, err := p.cfg.prober.Probe(cl.ctx, &net.IPNet{IP: ip, Mask: p.Mask}, p.cfg.probeTimeout)
+				if err == errShuttingDown || cl.ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					// An address which doesn't answer clearly may be in use
+					log.WithError(err).WithField("ip", ip).Debug("Error probing address during sweep, recording it in use")
+					r = true
+				}
+				o.set(ip, r)
+			}(ip)
+		}
+		lim.Stop()
+		wg.Wait()
+		o.lock.Lock()
+		o.swept = true
+		o.lock.Unlock()
+		log.WithField("pool", p.id()).WithField("took", time.Since(st)).Debug("Swept pool")
+
+		select {
+		case <-time.After(p.cfg.sweepInterval):
+		case <-cl.quit:
+			return
+		}
+	}
+}
+
+// usesNeighTable returns true if the probe method of p waits on the kernel
+// neighbor table. arp and dad fall back to it for IPv6.
+func usesNeighTable(p *pool) bool {
+	switch p.cfg.probe {
+	case ProbeARP, ProbeDAD:
+		return p.IP.To4() == nil
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingProber finds every address free after a delay, recording the most
+// probes it had running at once
+type countingProber struct {
+	lock    sync.Mutex
+	running int
+	max     int
+}
+
+func (p *countingProber) Probe(ctx context.Context, addr *net.IPNet, to time.Duration) (bool, error) {
+	p.lock.Lock()
+	p.running++
+	if p.running > p.max {
+		p.max = p.running
+	}
+	p.lock.Unlock()
+	select {
+	case <-time.After(20 * time.Millisecond):
+	case <-ctx.Done():
+	}
+	p.lock.Lock()
+	p.running--
+	p.lock.Unlock()
+	return false, ctx.Err()
+}
+
+func TestSweepLimitsProbes(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	pr := &countingProber{}
+	c := testConfig()
+	c.probe = ProbeARP
+	c.prober = pr
+	c.sweepInterval = time.Hour
+	c.sweepRate = maxSweepRate
+	_, p, cl := testCandidates(t, quit, "10.0.0.0/24", c)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl.ctx = ctx
+	o, err := newOccupancy(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cl.sweep(o)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o.lock.Lock()
+		swept := o.swept
+		o.lock.Unlock()
+		if swept {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Sweep did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	if pr.max > maxSweepProbes {
+		t.Errorf("%v probes running at once, want at most %v", pr.max, maxSweepProbes)
+	}
+}
+
+func TestUsesNeighTable(t *testing.T) {
+	for _, tc := range []struct {
+		id    string
+		probe string
+		neigh bool
+	}{
+		{"10.0.0.0/24", ProbeUDP, true},
+		{"10.0.0.0/24", ProbeICMP, true},
+		{"10.0.0.0/24", ProbeARP, false},
+		{"10.0.0.0/24", ProbeDAD, false},
+		{"fd00::/112", ProbeARP, true},
+		{"fd00::/112", ProbeDAD, true},
+	} {
+		p, err := parsePoolID(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.cfg = &poolConfig{probe: tc.probe}
+		if usesNeighTable(p) != tc.neigh {
+			t.Errorf("%v probing %v uses the neighbor table: %v, want %v", tc.probe, tc.id, !tc.neigh, tc.neigh)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package driver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+const feistelRounds = 4
+
+// Pools with more host bits than this are walked within a random window of
+// this size. They can never be exhausted in practice.
+const maxWalkBits = 64
+
+// addrWalker visits every address in a range exactly once in a random order,
+// using a keyed feistel permutation over the offsets into the range so no
+// record of visited addresses needs to be kept
+type addrWalker struct {
+	base *big.Int // first address in the range
+	v4   bool
+	max  uint64 // offset of the last address in the range
+	half uint   // bits in each half of the feistel network
+	keys [feistelRounds]uint64
+	ctr  uint64
+	done bool
+}
+
+// newAddrWalker returns a walker over the addresses in p which may be given out
+// randomly. The network and broadcast addresses are skipped, as are the first
+// and last addresses excluded by the pool config.
+func newAddrWalker(p *pool) (*addrWalker, error) {
+	n := p.IPNet
+	rng := p.randRange()
+	v4 := n.IP.To4() != nil
+
+	lo, hi := netBounds(n)
+	ones, bits := n.Mask.Size()
+	if bits-ones >= 2 { // This network is not a /31 exclude first and last
+		lo.Add(lo, big.NewInt(1))
+		hi.Sub(hi, big.NewInt(1))
+	}
+	lo.Add(lo, big.NewInt(int64(p.cfg.excludeFirst)))
+	hi.Sub(hi, big.NewInt(int64(p.cfg.excludeLast)))
+
+	start, end := netBounds(rng)
+	ones, bits = rng.Mask.Size()
+	if hostBits := bits - ones; hostBits > maxWalkBits {
+		w, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), uint(hostBits-maxWalkBits)))
+		if err != nil {
+			return nil, err
+		}
+		start.Add(start, w.Lsh(w, maxWalkBits))
+		end.Add(start, new(big.Int).SetUint64(^uint64(0)))
+	}
+	if start.Cmp(lo) < 0 {
+		start = lo
+	}
+	if end.Cmp(hi) > 0 {
+		end = hi
+	}
+	if start.Cmp(end) > 0 {
+		return nil, fmt.Errorf("No addresses available in %v", rng)
+	}
+
+	w := &addrWalker{
+		base: start,
+		v4:   v4,
+		max:  new(big.Int).Sub(end, start).Uint64(),
+	}
+	b := uint(2)
+	for b < 64 && w.max>>b != 0 {
+		b += 2
+	}
+	w.half = b / 2
+	k := make([]byte, 8*feistelRounds)
+	if _, err := rand.Read(k); err != nil {
+		return nil, err
+	}
+	for i := range w.keys {
+		w.keys[i] = binary.BigEndian.Uint64(k[i*8:])
+	}
+	return w, nil
+}
+
+// size returns the number of addresses in the walk
+func (w *addrWalker) size() float64 {
+	return float64(w.max) + 1
+}
+
+// contains returns true if ip is in the walk
+func (w *addrWalker) contains(ip net.IP) bool {
+	off := new(big.Int).Sub(ipToInt(ip), w.base)
+	return off.Sign() >= 0 && off.Cmp(new(big.Int).SetUint64(w.max)) <= 0
+}
+
+// next returns the next address, or false once every address has been visited
+func (w *addrWalker) next() (net.IP, bool) {
+	if w.done {
+		return nil, false
+	}
+	off := w.permute(w.ctr)
+	// cycle walk until the permutation lands inside the range
+	for off > w.max {
+		off = w.permute(off)
+	}
+	if w.ctr == w.max {
+		w.done = true
+	}
+	w.ctr++
+	ip := new(big.Int).Add(w.base, new(big.Int).SetUint64(off))
+	return intToIP(ip, w.v4), true
+}
+
+func (w *addrWalker) permute(x uint64) uint64 {
+	mask := uint64(1)<<w.half - 1
+	l, r := x>>w.half, x&mask
+	for _, k := range w.keys {
+		l, r = r, l^(feistelRound(r, k)&mask)
+	}
+	return l<<w.half | r
+}
+
+// feistelRound mixes x with the round key k (splitmix64 finalizer)
+func feistelRound(x, k uint64) uint64 {
+	x ^= k
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// netBounds returns the first and last addresses in n
+func netBounds(n *net.IPNet) (*big.Int, *big.Int) {
+	ones, bits := n.Mask.Size()
+	first := ipToInt(n.IP.Mask(n.Mask))
+	last := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last.Sub(last, big.NewInt(1))
+	return first, last.Add(last, first)
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+func intToIP(i *big.Int, v4 bool) net.IP {
+	l := net.IPv6len
+	if v4 {
+		l = net.IPv4len
+	}
+	b := i.Bytes()
+	ip := make(net.IP, l)
+	copy(ip[l-len(b):], b)
+	return ip
+}
@@ -0,0 +1,147 @@
+package driver
+
+import (
+	"math/big"
+	"net"
+	"testing"
+)
+
+func testPool(t *testing.T, p, sub string, excludeFirst, excludeLast int) *pool {
+	pl, err := newPool(p, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl.cfg = &poolConfig{excludeFirst: excludeFirst, excludeLast: excludeLast}
+	return pl
+}
+
+func TestAddrWalkerVisitsEach(t *testing.T) {
+	tests := []struct {
+		name         string
+		pool, sub    string
+		excludeFirst int
+		excludeLast  int
+		first, last  string // expected bounds of the walk
+		size         int
+	}{
+		{"/30", "10.0.0.0/30", "", 0, 0, "10.0.0.1", "10.0.0.2", 2},
+		{"/31", "10.0.0.0/31", "", 0, 0, "10.0.0.0", "10.0.0.1", 2},
+		{"/32", "10.0.0.5/32", "", 0, 0, "10.0.0.5", "10.0.0.5", 1},
+		{"/24", "10.0.0.0/24", "", 0, 0, "10.0.0.1", "10.0.0.254", 254},
+		{"sparse", "10.0.0.0/24", "", 10, 20, "10.0.0.11", "10.0.0.234", 224},
+		{"single", "10.0.0.0/24", "", 100, 153, "10.0.0.101", "10.0.0.101", 1},
+		{"sub pool", "10.0.0.0/24", "10.0.0.128/26", 0, 0, "10.0.0.128", "10.0.0.191", 64},
+		{"sub pool at the end", "10.0.0.0/24", "10.0.0.192/26", 0, 0, "10.0.0.192", "10.0.0.254", 63},
+		{"v6", "fd00::/120", "", 0, 0, "fd00::1", "fd00::fe", 254},
+	}
+	for _, tt := range tests {
+		w, err := newAddrWalker(testPool(t, tt.pool, tt.sub, tt.excludeFirst, tt.excludeLast))
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if int(w.size()) != tt.size {
+			t.Errorf("%v: size %v, want %v", tt.name, w.size(), tt.size)
+		}
+		first, last := ipToInt(net.ParseIP(tt.first)), ipToInt(net.ParseIP(tt.last))
+		seen := make(map[string]bool)
+		for ip, ok := w.next(); ok; ip, ok = w.next() {
+			if seen[ip.String()] {
+				t.Errorf("%v: %v visited twice", tt.name, ip)
+			}
+			seen[ip.String()] = true
+			if i := ipToInt(ip); i.Cmp(first) < 0 || i.Cmp(last) > 0 {
+				t.Errorf("%v: %v is outside %v-%v", tt.name, ip, tt.first, tt.last)
+			}
+			if !w.contains(ip) {
+				t.Errorf("%v: walk does not contain visited %v", tt.name, ip)
+			}
+			if len(seen) > tt.size {
+				t.Fatalf("%v: walk did not stop after %v addresses", tt.name, tt.size)
+			}
+		}
+		if len(seen) != tt.size {
+			t.Errorf("%v: visited %v addresses, want %v", tt.name, len(seen), tt.size)
+		}
+		if ip, ok := w.next(); ok {
+			t.Errorf("%v: exhausted walk returned %v", tt.name, ip)
+		}
+		before := new(big.Int).Sub(first, big.NewInt(1))
+		after := new(big.Int).Add(last, big.NewInt(1))
+		v4 := net.ParseIP(tt.first).To4() != nil
+		if w.contains(intToIP(before, v4)) || w.contains(intToIP(after, v4)) {
+			t.Errorf("%v: walk contains addresses outside %v-%v", tt.name, tt.first, tt.last)
+		}
+	}
+}
+
+func TestAddrWalkerEmpty(t *testing.T) {
+	if _, err := newAddrWalker(testPool(t, "10.0.0.0/24", "", 200, 100)); err == nil {
+		t.Error("Walker over fully excluded pool returned no error")
+	}
+}
+
+func TestAddrWalkerLargeV6(t *testing.T) {
+	tests := []struct {
+		pool, sub string
+	}{
+		{"fd00::/64", ""},
+		{"fd00::/48", ""},
+		{"fd00::/48", "fd00:0:0:5::/64"},
+		{"fd00::/32", "fd00:0:7::/48"},
+	}
+	for _, tt := range tests {
+		p := testPool(t, tt.pool, tt.sub, 0, 0)
+		w, err := newAddrWalker(p)
+		if err != nil {
+			t.Errorf("%v %v: %v", tt.pool, tt.sub, err)
+			continue
+		}
+		rng := p.randRange()
+		seen := make(map[string]bool)
+		for i := 0; i < 10000; i++ {
+			ip, ok := w.next()
+			if !ok {
+				t.Fatalf("%v %v: walk exhausted after %v addresses", tt.pool, tt.sub, i)
+			}
+			if !rng.Contains(ip) {
+				t.Errorf("%v %v: %v is outside %v", tt.pool, tt.sub, ip, rng)
+			}
+			if seen[ip.String()] {
+				t.Errorf("%v %v: %v visited twice", tt.pool, tt.sub, ip)
+			}
+			seen[ip.String()] = true
+		}
+	}
+}
+
+func TestIntToIP(t *testing.T) {
+	for _, s := range []string{"0.0.0.0", "10.0.0.1", "255.255.255.255", "::", "fd00::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"} {
+		ip := net.ParseIP(s)
+		if got := intToIP(ipToInt(ip), ip.To4() != nil); !got.Equal(ip) {
+			t.Errorf("intToIP(ipToInt(%v)) = %v", s, got)
+		}
+	}
+}
+
+func TestNetBounds(t *testing.T) {
+	tests := []struct {
+		n, first, last string
+	}{
+		{"10.0.0.7/30", "10.0.0.4", "10.0.0.7"},
+		{"10.0.0.0/24", "10.0.0.0", "10.0.0.255"},
+		{"10.0.0.1/32", "10.0.0.1", "10.0.0.1"},
+		{"fd00::/64", "fd00::", "fd00::ffff:ffff:ffff:ffff"},
+	}
+	for _, tt := range tests {
+		_, n, _ := net.ParseCIDR(tt.n)
+		first, last := netBounds(n)
+		v4 := n.IP.To4() != nil
+		if f := intToIP(first, v4); !f.Equal(net.ParseIP(tt.first)) {
+			t.Errorf("netBounds(%v) first = %v, want %v", tt.n, f, tt.first)
+		}
+		if l := intToIP(last, v4); !l.Equal(net.ParseIP(tt.last)) {
+			t.Errorf("netBounds(%v) last = %v, want %v", tt.n, l, tt.last)
+		}
+	}
+}
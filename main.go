@@ -1,20 +1,32 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	//"runtime/pprof"
+	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/TrilliumIT/docker-arp-ipam/driver"
-	//"github.com/docker/go-connections/sockets"
-	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli"
 )
 
 const version = "0.27"
 
+const pluginSockDir = "/run/docker/plugins"
+
 func main() {
 
 	app := cli.NewApp()
@@ -36,6 +48,35 @@ func main() {
 			Value: ":8080",
 			Usage: "TCP Address to bind the plugin on.",
 		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "TLS certificate for the TCP listener. Requires --tls-key, --tls-ca and a client certificate for dockerd. Dockerd verifies it against the host in --address.",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "TLS key for the TCP listener.",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA bundle used to verify client certificates. Clients without a valid certificate are refused. Dockerd also verifies the plugin's --tls-cert with it, so both certificates must be signed by it.",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-cert",
+			Usage: "Client certificate dockerd presents to the plugin, signed by --tls-ca. It is written to the plugin spec, dockerd must be able to read it. Required with TLS.",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-key",
+			Usage: "Key for --tls-client-cert. It is written to the plugin spec, dockerd must be able to read it. Required with TLS.",
+		},
+		cli.StringFlag{
+			Name:  "spec-dir",
+			Value: "/etc/docker/plugins",
+			Usage: "Directory to write the plugin spec to when listening on TCP. Must be one docker discovers plugins in.",
+		},
+		cli.BoolFlag{
+			Name:  "socket",
+			Usage: "Listen on a unix socket in /run/docker/plugins named for the plugin instead of TCP. Required when running as a managed plugin.",
+		},
 		cli.IntFlag{
 			Name:  "exclude-first, xf",
 			Value: 0,
@@ -46,8 +87,99 @@ func main() {
 			Value: 0,
 			Usage: "Exclude the last n addresses from each pool from being provided as random addresses",
 		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Value: "/var/lib/docker-arp-ipam",
+			Usage: "Directory to persist allocations in. Empty to keep allocations in memory only.",
+		},
+		cli.StringFlag{
+			Name:  "probe",
+			Value: driver.ProbeUDP,
+			Usage: "Method used to probe if an address is in use. One of: " + strings.Join(driver.ProbeMethods, ", "),
+		},
+		cli.StringSliceFlag{
+			Name:  "pool-probe",
+			Usage: "Probe method for a specific pool as <pool>=<method>. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "auto-pool-interface",
+			Usage: "Only assign pools automatically from interfaces matching this pattern. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "auto-pool-exclude-interface",
+			Usage: "Never assign pools automatically from interfaces matching this pattern. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "reserve",
+			Usage: "Reserve an address, range (<start>-<end>) or cidr so it is never provided, unless requested specifically from a pool whose arp-ipam.force option includes it. May be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "reservations-file",
+			Usage: "File of reservations, one address, range or cidr per line.",
+		},
+		cli.DurationFlag{
+			Name:  "sweep-interval",
+			Usage: "Probe every address in each pool this often in the background and prefer addresses silent longest. Pools larger than a /16 are never swept. Zero to disable.",
+		},
+		cli.IntFlag{
+			Name:  "sweep-rate",
+			Value: 10,
+			Usage: "Addresses probed per second while sweeping a pool, at most 10000. Probe methods using the neighbor table (udp, icmp, and arp or dad for IPv6) sweep at most 10.",
+		},
+		cli.DurationFlag{
+			Name:  "quarantine",
+			Usage: "Keep released addresses from being given out randomly for this long, so neighbors' stale arp entries expire first.",
+		},
+		cli.BoolFlag{
+			Name:  "announce",
+			Usage: "Send gratuitous arp (unsolicited neighbor advertisements for IPv6) for allocated addresses once their endpoint appears.",
+		},
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "YAML configuration file applied over these flags. Reloaded on SIGHUP.",
+		},
+		cli.StringFlag{
+			Name:  "address-spaces",
+			Usage: "YAML file of named address spaces, each with default pool options.",
+		},
+		cli.StringFlag{
+			Name:  "coordinator",
+			Usage: "Lease addresses in the global address space from a backend shared between hosts. Only " + driver.CoordinatorConsul + " is supported. Disabled if empty.",
+		},
+		cli.StringFlag{
+			Name:  "coordinator-address",
+			Value: "127.0.0.1:8500",
+			Usage: "Address of the coordination backend.",
+		},
+		cli.StringFlag{
+			Name:  "coordinator-prefix",
+			Value: "docker-arp-ipam",
+			Usage: "Prefix of leases in the coordination backend.",
+		},
+		cli.StringFlag{
+			Name:  "coordinator-owner",
+			Usage: "Name of this host in leases. Defaults to the hostname.",
+		},
+		cli.StringFlag{
+			Name:  "conflict-webhook",
+			Usage: "URL to POST a JSON event to when an allocated address is seen at a MAC other than its endpoint's.",
+		},
+		cli.StringFlag{
+			Name:  "metrics-address",
+			Usage: "TCP Address to serve prometheus metrics on at /metrics. Disabled if empty.",
+		},
+		cli.StringFlag{
+			Name:  "admin-address",
+			Usage: "TCP Address to serve the admin API on. It is unauthenticated and can trigger probes and release allocations, bind it to localhost. Disabled if empty.",
+		},
+		cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Value: 10 * time.Second,
+			Usage: "Time to let in-flight requests finish on shutdown before they fail.",
+		},
 	}
 	app.Action = Run
+	app.Commands = commands
 	err := app.Run(os.Args)
 	if err != nil {
 		log.WithError(err).Fatal("Error from app")
@@ -66,70 +198,315 @@ func Run(ctx *cli.Context) error {
 		FullTimestamp:    true,
 	})
 	log.WithField("Version", version).Info("Starting")
-	xf := ctx.Int("xf")
-	xl := ctx.Int("xl")
+	opts := &driver.Options{
+		ExcludeFirst: ctx.Int("xf"),
+		ExcludeLast:  ctx.Int("xl"),
+		StateDir:     ctx.String("state-dir"),
+		Probe:        ctx.String("probe"),
+		PoolProbes:   make(map[string]string),
+
+		AutoPoolInterfaces:        ctx.StringSlice("auto-pool-interface"),
+		AutoPoolExcludeInterfaces: ctx.StringSlice("auto-pool-exclude-interface"),
+		Reservations:              ctx.StringSlice("reserve"),
+		ReservationsFile:          ctx.String("reservations-file"),
+		SweepInterval:             ctx.Duration("sweep-interval"),
+		SweepRate:                 ctx.Int("sweep-rate"),
+		Quarantine:                ctx.Duration("quarantine"),
+		Announce:                  ctx.Bool("announce"),
+		ConflictWebhook:           ctx.String("conflict-webhook"),
+		AddressSpacesFile:         ctx.String("address-spaces"),
+		ConfigFile:                ctx.String("config"),
+		Coordination: driver.CoordinatorOptions{
+			Backend: ctx.String("coordinator"),
+			Owner:   ctx.String("coordinator-owner"),
+			Address: ctx.String("coordinator-address"),
+			Prefix:  ctx.String("coordinator-prefix"),
+		},
+	}
+	if opts.Coordination.Owner == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			log.WithError(err).Error("Error getting hostname")
+			return err
+		}
+		opts.Coordination.Owner = h
+	}
+	for _, pp := range ctx.StringSlice("pool-probe") {
+		kv := strings.SplitN(pp, "=", 2)
+		if len(kv) != 2 {
+			log.WithField("pool-probe", pp).Error("Invalid pool probe, expected <pool>=<method>")
+			return fmt.Errorf("invalid pool probe: %v", pp)
+		}
+		opts.PoolProbes[kv[0]] = kv[1]
+	}
+
+	tlsConfig, err := serverTLSConfig(ctx)
+	if err != nil {
+		log.WithError(err).Error("Error configuring TLS")
+		return err
+	}
+	l, cleanup, err := pluginListener(ctx, tlsConfig)
+	if err != nil {
+		log.WithError(err).Error("Error creating plugin listener")
+		return err
+	}
+	defer cleanup()
 
 	quit := make(chan struct{}) // tells other goroutines to quit
 
-	d := driver.NewDriver(quit, xf, xl)
+	d, err := driver.NewDriver(quit, opts)
+	if err != nil {
+		log.WithError(err).Error("Error creating driver")
+		l.Close()
+		return err
+	}
+
+	var httpListeners []*httpListener
+	if addr := ctx.String("metrics-address"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		hl, err := listenHTTP(addr, mux)
+		if err != nil {
+			log.WithError(err).Error("Error creating metrics listener")
+			l.Close()
+			return err
+		}
+		httpListeners = append(httpListeners, hl)
+	}
+	if addr := ctx.String("admin-address"); addr != "" {
+		hl, err := listenHTTP(addr, d.AdminHandler())
+		if err != nil {
+			log.WithError(err).Error("Error creating admin listener")
+			for _, hl := range httpListeners {
+				hl.l.Close()
+			}
+			l.Close()
+			return err
+		}
+		httpListeners = append(httpListeners, hl)
+	}
 
 	dErrCh := make(chan error) // catches an error from driver
 	go func() {
 		dErrCh <- d.Start()
 	}()
 
-	h := ipam.NewHandler(d)
-	lErrCh := make(chan error) // catches an error from serveTCP
+	h := d.Handler()
+	lErrCh := make(chan error) // catches an error from the plugin listener
 	go func() {
-		lErrCh <- h.ServeTCP(ctx.String("plugin-name"), ctx.String("address"), "/tmp", nil)
+		lErrCh <- h.Serve(l)
 	}()
 
+	hErrCh := make(chan error) // catches an error from an http listener
+	for _, hl := range httpListeners {
+		go func(hl *httpListener) {
+			err := hl.srv.Serve(hl.l)
+			if err == http.ErrServerClosed {
+				return
+			}
+			select {
+			case hErrCh <- err:
+			case <-quit:
+			}
+		}(hl)
+	}
+
 	c := make(chan os.Signal, 32)
 	defer close(c)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	var retErr error // holds the final return value
-	select {
-	case <-c:
-		log.Debugf("Sigterm caught. Closing")
-		/*
-			if log.GetLevel() == log.DebugLevel {
-					log.Debug("Dumping stack traces for all goroutines")
-					if err := pprof.Lookup("goroutine").WriteTo(os.Stdout, 1); err != nil {
-						log.WithError(err).Error("Error getting stack trace")
-					}
+	listening, running := true, true
+waitLoop:
+	for {
+		select {
+		case <-hup:
+			log.Info("Sighup caught. Reloading configuration")
+			if err := d.Reload(); err != nil {
+				log.WithError(err).Error("Error reloading configuration, keeping the previous configuration")
 			}
-		*/
-	case err := <-lErrCh:
-		if err != nil {
-			log.WithError(err).Error("Error from listener")
-			retErr = err
-		}
-	case err := <-dErrCh:
-		if err != nil {
-			log.WithError(err).Error("Error from driver")
+			continue
+		case <-c:
+			log.Debugf("Sigterm caught. Closing")
+			/*
+				if log.GetLevel() == log.DebugLevel {
+						log.Debug("Dumping stack traces for all goroutines")
+						if err := pprof.Lookup("goroutine").WriteTo(os.Stdout, 1); err != nil {
+							log.WithError(err).Error("Error getting stack trace")
+						}
+				}
+			*/
+		case err := <-lErrCh:
+			listening = false
+			if err != nil {
+				log.WithError(err).Error("Error from listener")
+				retErr = err
+			}
+		case err := <-dErrCh:
+			running = false
+			if err != nil {
+				log.WithError(err).Error("Error from driver")
+				retErr = err
+			}
+		case err := <-hErrCh:
+			log.WithError(err).Error("Error from http listener")
 			retErr = err
 		}
+		break waitLoop
 	}
+	signal.Stop(hup)
 
-	select {
-	case err := <-lErrCh:
-		if err != nil {
-			log.WithError(err).Error("Error from listener")
-			retErr = err
+	// Stop accepting requests, then give those in flight a chance to finish
+	// before quit fails them
+	if err := l.Close(); err != nil {
+		log.WithError(err).Warn("Error closing plugin listener")
+	}
+	for _, hl := range httpListeners {
+		if err := hl.srv.Close(); err != nil {
+			log.WithError(err).Warn("Error closing http listener")
 		}
-	default:
+	}
+	if listening {
+		<-lErrCh // Serve always errors once its listener is closed
 	}
 	close(lErrCh)
+	d.Drain(ctx.Duration("shutdown-timeout"))
 
 	close(quit)
-	err := <-dErrCh
-	if err != nil {
-		log.WithError(err).Error("Error from driver")
-		retErr = err
+	if running {
+		if err := <-dErrCh; err != nil {
+			log.WithError(err).Error("Error from driver")
+			retErr = err
+		}
 	}
 	close(dErrCh)
 
 	return retErr
 }
+
+// pluginListener opens the listener docker connects to and writes its spec
+// file. It is opened here rather than by the plugin helpers so it can be closed
+// on shutdown. cleanup removes the spec file once the listener is closed.
+func pluginListener(ctx *cli.Context, tlsConfig *tls.Config) (l net.Listener, cleanup func(), err error) {
+	name := ctx.String("plugin-name")
+	if ctx.Bool("socket") {
+		if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+			return nil, nil, err
+		}
+		l, err := sockets.NewUnixSocket(filepath.Join(pluginSockDir, name+".sock"), 0)
+		return l, func() {}, err
+	}
+	l, err = sockets.NewTCPSocket(ctx.String("address"), tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := "tcp://" + l.Addr().String()
+	if tlsConfig != nil {
+		// Docker only uses TLS for an https address, and verifies the
+		// certificate against its host
+		addr = "https://" + ctx.String("address")
+	}
+	spec, err := writeSpec(ctx, name, addr, tlsConfig != nil)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+	return l, func() {
+		if err := os.Remove(spec); err != nil {
+			log.WithError(err).WithField("spec", spec).Warn("Error removing plugin spec")
+		}
+	}, nil
+}
+
+// httpListener is an http server and the listener it serves on
+type httpListener struct {
+	srv *http.Server
+	l   net.Listener
+}
+
+// listenHTTP opens the listener for an http server, so a bad address fails at
+// startup rather than once the driver is running
+func listenHTTP(addr string, h http.Handler) (*httpListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &httpListener{srv: &http.Server{Handler: h}, l: l}, nil
+}
+
+// pluginSpec is the json plugin spec, which dockerd needs to connect with TLS
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *specTLSConfig `json:",omitempty"`
+}
+
+type specTLSConfig struct {
+	InsecureSkipVerify bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+}
+
+// writeSpec writes the spec file docker discovers the plugin by, returning its
+// path. A plain .spec file has only the address, with TLS a .json spec also
+// tells dockerd the CA to verify the plugin with and the client certificate to
+// present.
+func writeSpec(ctx *cli.Context, name, addr string, useTLS bool) (string, error) {
+	dir := ctx.String("spec-dir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if !useTLS {
+		spec := filepath.Join(dir, name+".spec")
+		return spec, ioutil.WriteFile(spec, []byte(addr), 0644)
+	}
+	s := &pluginSpec{Name: name, Addr: addr, TLSConfig: &specTLSConfig{}}
+	for _, f := range []struct {
+		flag string
+		path *string
+	}{
+		{"tls-ca", &s.TLSConfig.CAFile},
+		{"tls-client-cert", &s.TLSConfig.CertFile},
+		{"tls-client-key", &s.TLSConfig.KeyFile},
+	} {
+		p, err := filepath.Abs(ctx.String(f.flag))
+		if err != nil {
+			return "", err
+		}
+		*f.path = p
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	spec := filepath.Join(dir, name+".json")
+	return spec, ioutil.WriteFile(spec, b, 0644)
+}
+
+// serverTLSConfig returns the TLS config for the TCP listener, or nil if TLS is not configured
+func serverTLSConfig(ctx *cli.Context) (*tls.Config, error) {
+	cert, key, ca := ctx.String("tls-cert"), ctx.String("tls-key"), ctx.String("tls-ca")
+	clientCert, clientKey := ctx.String("tls-client-cert"), ctx.String("tls-client-key")
+	if cert == "" && key == "" && ca == "" && clientCert == "" && clientKey == "" {
+		return nil, nil
+	}
+	if ctx.Bool("socket") {
+		return nil, fmt.Errorf("TLS is not supported with --socket")
+	}
+	if cert == "" || key == "" || ca == "" || clientCert == "" || clientKey == "" {
+		return nil, fmt.Errorf("--tls-cert, --tls-key, --tls-ca, --tls-client-cert and --tls-client-key are all required to enable TLS")
+	}
+	if host, _, err := net.SplitHostPort(ctx.String("address")); err != nil || host == "" {
+		return nil, fmt.Errorf("--address must include the host in the TLS certificate to enable TLS")
+	}
+	return tlsconfig.Server(tlsconfig.Options{
+		CertFile:   cert,
+		KeyFile:    key,
+		CAFile:     ca,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+}
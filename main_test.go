@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestTLSPluginSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp-ipam-spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for k, v := range map[string]string{
+		"address":         "localhost:0",
+		"plugin-name":     "arp-ipam",
+		"spec-dir":        dir,
+		"tls-ca":          "/certs/ca.pem",
+		"tls-client-cert": "/certs/client.pem",
+		"tls-client-key":  "/certs/client-key.pem",
+	} {
+		set.String(k, v, "")
+	}
+	set.Bool("socket", false, "")
+	ctx := cli.NewContext(nil, set, nil)
+
+	l, cleanup, err := pluginListener(ctx, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	defer l.Close()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "arp-ipam.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s pluginSpec
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	// Docker only connects with TLS to an https address, and verifies the
+	// host given, not the address the listener resolved
+	if s.Addr != "https://localhost:0" {
+		t.Errorf("Addr %q, want https://localhost:0", s.Addr)
+	}
+	if s.TLSConfig == nil {
+		t.Fatal("No TLS config in spec")
+	}
+	if s.TLSConfig.CAFile != "/certs/ca.pem" || s.TLSConfig.CertFile != "/certs/client.pem" || s.TLSConfig.KeyFile != "/certs/client-key.pem" {
+		t.Errorf("TLS config %+v", s.TLSConfig)
+	}
+}